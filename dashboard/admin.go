@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	channelsKey          = "channels"
+	suspendedChannelsKey = "suspended-channels"
+	allowedChannelsKey   = "allowed-channels"
+)
+
+var errChannelUnavailable = errors.New("channel suspended or not allowed")
+
+// channelStatus is what the operator decided about a channel.
+type channelStatus struct {
+	Suspended     bool
+	SuspendReason string
+	Allowed       bool
+}
+
+// channelRegistry knows every channel that ever logged in or received a
+// message, and what the operators of the service decided about them: the
+// user IDs in OPERATOR_IDS can suspend channels and, when ALLOWLIST_ONLY is
+// set, pick the only channels that get in.
+type channelRegistry struct {
+	redisConn     *redis.Client
+	operators     map[string]bool
+	allowlistOnly bool
+}
+
+func newChannelRegistry(redisConn *redis.Client) *channelRegistry {
+	operators := make(map[string]bool)
+	for _, id := range strings.Split(envString("OPERATOR_IDS", ""), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			operators[id] = true
+		}
+	}
+	allowlistOnly, _ := strconv.ParseBool(envString("ALLOWLIST_ONLY", "false"))
+	return &channelRegistry{redisConn: redisConn, operators: operators, allowlistOnly: allowlistOnly}
+}
+
+// IsOperator tells whether userID operates the service.
+func (c *channelRegistry) IsOperator(userID string) bool {
+	return c.operators[userID]
+}
+
+func (c *channelRegistry) Register(ctx context.Context, channelID string) {
+	if err := c.redisConn.SAdd(ctx, channelsKey, channelID).Err(); err != nil {
+		slog.Error("registering channel", logChannelID, channelID, "error", err)
+	}
+}
+
+// Registered tells whether channelID logged in, or received a message,
+// before.
+func (c *channelRegistry) Registered(ctx context.Context, channelID string) (bool, error) {
+	return c.redisConn.SIsMember(ctx, channelsKey, channelID).Result()
+}
+
+// All returns every registered channel.
+func (c *channelRegistry) All(ctx context.Context) ([]string, error) {
+	channels, err := c.redisConn.SMembers(ctx, channelsKey).Result()
+	sort.Strings(channels)
+	return channels, err
+}
+
+func (c *channelRegistry) Status(ctx context.Context, channelID string) (channelStatus, error) {
+	pipe := c.redisConn.Pipeline()
+	reason := pipe.HGet(ctx, suspendedChannelsKey, channelID)
+	allowed := pipe.SIsMember(ctx, allowedChannelsKey, channelID)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return channelStatus{}, err
+	}
+	return channelStatus{
+		Suspended:     reason.Err() == nil,
+		SuspendReason: reason.Val(),
+		Allowed:       allowed.Val(),
+	}, nil
+}
+
+// Available tells whether channelID may use the service: it isn't
+// suspended and, in allowlist-only mode, it was allowed.
+func (c *channelRegistry) Available(ctx context.Context, channelID string) (bool, error) {
+	status, err := c.Status(ctx, channelID)
+	if err != nil {
+		return false, err
+	}
+	return !status.Suspended && (!c.allowlistOnly || status.Allowed), nil
+}
+
+func (c *channelRegistry) Suspend(ctx context.Context, channelID, reason string) error {
+	return c.redisConn.HSet(ctx, suspendedChannelsKey, channelID, reason).Err()
+}
+
+func (c *channelRegistry) Unsuspend(ctx context.Context, channelID string) error {
+	return c.redisConn.HDel(ctx, suspendedChannelsKey, channelID).Err()
+}
+
+func (c *channelRegistry) Allow(ctx context.Context, channelID string) error {
+	return c.redisConn.SAdd(ctx, allowedChannelsKey, channelID).Err()
+}
+
+func (c *channelRegistry) Disallow(ctx context.Context, channelID string) error {
+	return c.redisConn.SRem(ctx, allowedChannelsKey, channelID).Err()
+}
+
+// adminChannel is a row of the admin page.
+type adminChannel struct {
+	Profile  profile
+	Online   bool
+	Settings *channelSettings
+	Quota    quotaStatus
+	Status   channelStatus
+}
+
+// HandleAdmin lists every channel of the service for its operators.
+func HandleAdmin(hub *Hub, redisConn *redis.Client, channels *channelRegistry, quotas *quotaTracker, profiles *profileCache, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	if _, ok := dashboardAccess(w, r, moderators, permOperate); !ok {
+		return
+	}
+	ctx := r.Context()
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		slog.Error("creating csrf token", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ids, err := channels.All(ctx)
+	if err != nil {
+		slog.Error("listing channels", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	found := profiles.Lookup(ctx, ids)
+	rows := make([]adminChannel, 0, len(ids))
+	var day, month quotaUsage
+	for _, id := range ids {
+		row := adminChannel{Profile: found[id]}
+		_, row.Online = hub.Overlay(id)
+		if row.Settings, err = loadSettings(ctx, redisConn, id); err != nil {
+			slog.Error("loading settings", logChannelID, id, "error", err)
+		}
+		if row.Status, err = channels.Status(ctx, id); err != nil {
+			slog.Error("loading channel status", logChannelID, id, "error", err)
+		}
+		if row.Quota, err = quotas.Status(ctx, id); err != nil {
+			slog.Error("loading quota status", logChannelID, id, "error", err)
+		}
+		day.Requests += row.Quota.Day.Requests
+		day.Characters += row.Quota.Day.Characters
+		month.Requests += row.Quota.Month.Requests
+		month.Characters += row.Quota.Month.Characters
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Online && !rows[j].Online })
+
+	tmpl, err := template.New("admin").Parse(adminHTML)
+	if err != nil {
+		slog.Error("creating admin template", "error", err)
+		return
+	}
+	parsed := bytes.NewBufferString("")
+	err = tmpl.Execute(parsed, struct {
+		CSRFToken     string
+		AllowlistOnly bool
+		Defaults      quotaLimits
+		Day           quotaUsage
+		Month         quotaUsage
+		Channels      []adminChannel
+	}{
+		CSRFToken:     csrf,
+		AllowlistOnly: channels.allowlistOnly,
+		Defaults:      quotas.defaults,
+		Day:           day,
+		Month:         month,
+		Channels:      rows,
+	})
+	if err != nil {
+		slog.Error("rendering admin template", "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(parsed.Bytes())
+}
+
+// HandleAdminChannel enables, disables, suspends or allows a channel, or
+// changes its quotas.
+func HandleAdminChannel(hub *Hub, redisConn *redis.Client, extConfig *extensionConfig, channels *channelRegistry, quotas *quotaTracker, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permOperate)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	channelID := r.PostFormValue("channel_id")
+	action := r.PostFormValue("action")
+
+	var err error
+	switch action {
+	case "enable", "disable":
+		var old *channelSettings
+		if old, err = loadSettings(ctx, redisConn, channelID); err != nil {
+			break
+		}
+		settings := *old
+		settings.Enabled = action == "enable"
+		if err = applySettings(ctx, hub, redisConn, extConfig, channelID, &settings); err == nil {
+			audit.Record(ctx, user.UserID, channelID, auditSettings, "", old, &settings)
+		}
+	case "suspend":
+		reason := strings.TrimSpace(r.PostFormValue("reason"))
+		if err = channels.Suspend(ctx, channelID, reason); err == nil {
+			audit.Record(ctx, user.UserID, channelID, auditChannelSuspend, channelID, nil, reason)
+		}
+	case "unsuspend":
+		if err = channels.Unsuspend(ctx, channelID); err == nil {
+			audit.Record(ctx, user.UserID, channelID, auditChannelUnsuspend, channelID, nil, nil)
+		}
+	case "allow":
+		if err = channels.Allow(ctx, channelID); err == nil {
+			audit.Record(ctx, user.UserID, channelID, auditChannelAllow, channelID, nil, nil)
+		}
+	case "disallow":
+		if err = channels.Disallow(ctx, channelID); err == nil {
+			audit.Record(ctx, user.UserID, channelID, auditChannelDisallow, channelID, nil, nil)
+		}
+	case "quota", "quota-reset":
+		var old quotaLimits
+		if old, _, err = quotas.Limits(ctx, channelID); err != nil {
+			break
+		}
+		var limits *quotaLimits
+		if action == "quota" {
+			limits = quotaLimitsFromForm(r)
+		}
+		if err = quotas.SetLimits(ctx, channelID, limits); err == nil {
+			after := quotas.defaults
+			if limits != nil {
+				after = *limits
+			}
+			audit.Record(ctx, user.UserID, channelID, auditQuota, channelID, old, after)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("changing channel", logChannelID, channelID, logUserID, user.UserID, "action", action, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("channel changed", logChannelID, channelID, logUserID, user.UserID, "action", action)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// renderUnavailable tells the broadcaster of channelID why their channel
+// can't use the service.
+func renderUnavailable(channels *channelRegistry, w http.ResponseWriter, r *http.Request, channelID string) {
+	status, err := channels.Status(r.Context(), channelID)
+	if err != nil {
+		slog.Error("loading channel status", logChannelID, channelID, "error", err)
+	}
+	tmpl, err := template.New("unavailable").Parse(unavailableHTML)
+	if err != nil {
+		slog.Error("creating unavailable template", "error", err)
+		return
+	}
+	parsed := bytes.NewBufferString("")
+	if err = tmpl.Execute(parsed, status); err != nil {
+		slog.Error("rendering unavailable template", "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write(parsed.Bytes())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// pendingMessage is a message waiting for the streamer's approval, in
+// channels with approval mode on.
+type pendingMessage struct {
+	Message   *Message  `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func pendingKey(channelID string) string {
+	return "pending:" + channelID
+}
+
+func addPending(ctx context.Context, redisConn *redis.Client, message *Message) error {
+	b, err := json.Marshal(pendingMessage{Message: message, CreatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return redisConn.HSet(ctx, pendingKey(message.ClientID), message.ID, b).Err()
+}
+
+// listPending returns the messages awaiting approval on channelID, oldest
+// first.
+func listPending(ctx context.Context, redisConn *redis.Client, channelID string) ([]pendingMessage, error) {
+	values, err := redisConn.HGetAll(ctx, pendingKey(channelID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]pendingMessage, 0, len(values))
+	for _, value := range values {
+		var p pendingMessage
+		if json.Unmarshal([]byte(value), &p) == nil {
+			pending = append(pending, p)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+	return pending, nil
+}
+
+// takePending removes a message from the approval queue and returns it, or
+// redis.Nil if it is not there (anymore).
+func takePending(ctx context.Context, redisConn *redis.Client, channelID, messageID string) (*Message, error) {
+	b, err := redisConn.HGet(ctx, pendingKey(channelID), messageID).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	removed, err := redisConn.HDel(ctx, pendingKey(channelID), messageID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if removed == 0 {
+		// someone else approved or rejected it meanwhile
+		return nil, redis.Nil
+	}
+	var p pendingMessage
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return p.Message, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// audioFormat is an encoding HandleTTSPlay knows how to serve.
+type audioFormat struct {
+	Name        string
+	ContentType string
+
+	// ffmpeg output options
+	codec []string
+}
+
+var (
+	audioFormats = map[string]audioFormat{
+		"wav":  {Name: "wav", ContentType: "audio/wav", codec: []string{"-c:a", "pcm_s16le", "-f", "wav"}},
+		"mp3":  {Name: "mp3", ContentType: "audio/mpeg", codec: []string{"-c:a", "libmp3lame", "-b:a", "96k", "-f", "mp3"}},
+		"opus": {Name: "opus", ContentType: "audio/ogg; codecs=opus", codec: []string{"-c:a", "libopus", "-b:a", "48k", "-f", "ogg"}},
+	}
+
+	// ffmpegPath is empty when there is no ffmpeg available; audio is then
+	// served exactly as the TTS worker stored it. main looks it up with
+	// lookupFFmpeg.
+	ffmpegPath string
+
+	// targetLUFS is the integrated loudness every audio is normalized to.
+	targetLUFS = envFloat("AUDIO_TARGET_LUFS", -16)
+)
+
+const (
+	defaultAudioFormat = "wav"
+	transcodeTimeout   = 30 * time.Second
+)
+
+func lookupFFmpeg() string {
+	name := os.Getenv("FFMPEG_PATH")
+	if name == "" {
+		name = "ffmpeg"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		slog.Warn("ffmpeg not found, audio post-processing disabled", "error", err)
+		return ""
+	}
+	return path
+}
+
+var errAudioChannel = errors.New("audio belongs to another channel")
+
+// loadAudio returns audioID encoded as format, along with its metadata. The
+// audio is returned as the TTS worker stored it when ffmpeg is not available
+// or fails.
+func loadAudio(ctx context.Context, redisConn *redis.Client, audioID, channelID string, format audioFormat) ([]byte, *audioMeta, error) {
+	b, err := redisConn.Get(ctx, audioID).Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta, err := loadAudioMeta(ctx, redisConn, audioID)
+	if err != nil {
+		// áudio gerado antes dos metadados existirem
+		meta = newAudioMeta(channelID, b)
+	}
+	if meta.ChannelID != channelID {
+		return nil, nil, errAudioChannel
+	}
+
+	if ffmpegPath == "" {
+		return b, meta, nil
+	}
+	processed, err := processAudio(ctx, redisConn, audioID, b, format)
+	if err != nil {
+		slog.Error("processing audio, serving the original", logChannelID, channelID, "audio_id", audioID, "format", format.Name, "error", err)
+		return b, meta, nil
+	}
+	processedMeta := newAudioMeta(channelID, processed)
+	processedMeta.ContentType, processedMeta.CreatedAt = format.ContentType, meta.CreatedAt
+	return processed, processedMeta, nil
+}
+
+// negotiateAudioFormat picks the format to serve from the "format" query
+// parameter or, when absent, from the Accept header.
+func negotiateAudioFormat(r *http.Request) (audioFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		format, ok := audioFormats[strings.ToLower(name)]
+		return format, ok
+	}
+
+	type accepted struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []accepted
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		if q > 0 {
+			ranges = append(ranges, accepted{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, a := range ranges {
+		switch a.mediaType {
+		case "*/*", "audio/*":
+			return audioFormats[defaultAudioFormat], true
+		case "audio/wav", "audio/wave", "audio/x-wav":
+			return audioFormats["wav"], true
+		case "audio/mpeg", "audio/mp3":
+			return audioFormats["mp3"], true
+		case "audio/ogg", "audio/opus":
+			return audioFormats["opus"], true
+		}
+	}
+	return audioFormats[defaultAudioFormat], len(ranges) == 0
+}
+
+// processAudio returns audioID normalized, trimmed and encoded as format,
+// caching the result in Redis alongside the original.
+func processAudio(ctx context.Context, redisConn *redis.Client, audioID string, original []byte, format audioFormat) ([]byte, error) {
+	key := audioID + ":" + format.Name
+	if b, err := redisConn.Get(ctx, key).Bytes(); err == nil {
+		return b, nil
+	}
+
+	b, err := transcode(ctx, original, format)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := redisConn.PTTL(ctx, audioID).Result()
+	if err != nil || ttl < 0 {
+		ttl = 0
+	}
+	if err = redisConn.Set(ctx, key, b, ttl).Err(); err != nil {
+		slog.Error("caching processed audio", "key", key, "error", err)
+	}
+	audioSize.WithLabelValues(format.Name).Observe(float64(len(b)))
+	return b, nil
+}
+
+// transcode runs the audio through ffmpeg: leading and trailing silence is
+// trimmed, loudness is normalized to targetLUFS and the result is encoded
+// as format.
+func transcode(ctx context.Context, in []byte, format audioFormat) ([]byte, error) {
+	if ffmpegPath == "" {
+		return nil, fmt.Errorf("ffmpeg not available")
+	}
+	ctx, cancel := context.WithTimeout(ctx, transcodeTimeout)
+	defer cancel()
+
+	const trim = "silenceremove=start_periods=1:start_threshold=-50dB,areverse"
+	filter := fmt.Sprintf("%s,%s,loudnorm=I=%.1f:TP=-1.5:LRA=11", trim, trim, targetLUFS)
+	args := append([]string{
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-af", filter,
+		"-ar", "48000",
+	}, format.codec...)
+	args = append(args, "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateAudioFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"nothing asked", "", "", "wav", true},
+		{"format parameter", "?format=mp3", "", "mp3", true},
+		{"format parameter in upper case", "?format=OPUS", "", "opus", true},
+		{"format parameter wins", "?format=mp3", "audio/ogg", "mp3", true},
+		{"unknown format parameter", "?format=flac", "", "", false},
+		{"accept", "", "audio/mpeg", "mp3", true},
+		{"accept by quality", "", "audio/wav;q=0.5, audio/ogg;q=0.9", "opus", true},
+		{"accept skips unknown types", "", "audio/flac, audio/mpeg;q=0.1", "mp3", true},
+		{"accept wildcard", "", "audio/*", "wav", true},
+		{"accept refuses a type", "", "audio/mpeg;q=0, audio/ogg", "opus", true},
+		{"accept only unknown types", "", "audio/flac", "", false},
+		{"malformed accept", "", ";;;", "wav", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ttsPlay/audio-1"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			format, ok := negotiateAudioFormat(r)
+			if ok != tt.ok {
+				t.Fatalf("negotiateAudioFormat() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && format.Name != tt.want {
+				t.Errorf("negotiateAudioFormat() = %q, want %q", format.Name, tt.want)
+			}
+		})
+	}
+}
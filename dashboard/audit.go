@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditSettings         = "settings.update"
+	auditLayerThemeSave   = "layer_theme.save"
+	auditLayerThemeDelete = "layer_theme.delete"
+	auditModeratorAdd     = "moderator.add"
+	auditModeratorRemove  = "moderator.remove"
+	auditModeratorsImport = "moderator.import"
+	auditBlock            = "viewer.block"
+	auditUnblock          = "viewer.unblock"
+	auditApprove          = "message.approve"
+	auditReject           = "message.reject"
+	auditReplay           = "message.replay"
+	auditTestMessage      = "message.test"
+	auditEmotesRefresh    = "emotes.refresh"
+	auditChannelSuspend   = "channel.suspend"
+	auditChannelUnsuspend = "channel.unsuspend"
+	auditChannelAllow     = "channel.allow"
+	auditChannelDisallow  = "channel.disallow"
+	auditQuota            = "channel.quota"
+)
+
+var (
+	auditActions = []string{
+		auditSettings, auditLayerThemeSave, auditLayerThemeDelete,
+		auditModeratorAdd, auditModeratorRemove, auditModeratorsImport,
+		auditBlock, auditUnblock, auditApprove, auditReject, auditReplay,
+		auditTestMessage, auditEmotesRefresh,
+		auditChannelSuspend, auditChannelUnsuspend, auditChannelAllow, auditChannelDisallow,
+		auditQuota,
+	}
+	auditActionNames = map[string]string{
+		auditSettings:         "alterou as configurações",
+		auditLayerThemeSave:   "salvou um tema",
+		auditLayerThemeDelete: "apagou um tema",
+		auditModeratorAdd:     "adicionou um moderador",
+		auditModeratorRemove:  "removeu um moderador",
+		auditModeratorsImport: "importou os moderadores da Twitch",
+		auditBlock:            "bloqueou um viewer",
+		auditUnblock:          "desbloqueou um viewer",
+		auditApprove:          "aprovou uma mensagem",
+		auditReject:           "rejeitou uma mensagem",
+		auditReplay:           "tocou uma mensagem de novo",
+		auditTestMessage:      "enviou uma mensagem de teste",
+		auditEmotesRefresh:    "atualizou os emotes",
+		auditChannelSuspend:   "suspendeu o canal",
+		auditChannelUnsuspend: "reativou o canal",
+		auditChannelAllow:     "liberou o canal no beta",
+		auditChannelDisallow:  "tirou o canal do beta",
+		auditQuota:            "alterou as cotas do canal",
+	}
+)
+
+const (
+	// auditPageSize is how many entries the audit page shows.
+	auditPageSize = 100
+	// auditBatchSize is how many entries are read from Redis at a time.
+	auditBatchSize = 500
+)
+
+// auditEntry is an administrative action on a channel: who did what, to
+// what, and what it was before and after.
+type auditEntry struct {
+	ID        string          `json:"id"`
+	At        time.Time       `json:"at"`
+	ActorID   string          `json:"actor_id"`
+	ChannelID string          `json:"channel_id"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target,omitempty"`
+	Old       json.RawMessage `json:"old,omitempty"`
+	New       json.RawMessage `json:"new,omitempty"`
+}
+
+// OldValue and NewValue show the values of the entry on the audit page.
+func (e *auditEntry) OldValue() string { return string(e.Old) }
+func (e *auditEntry) NewValue() string { return string(e.New) }
+
+// auditLog keeps the audit log of each channel in a Redis stream, which is
+// only ever appended to.
+type auditLog struct {
+	redisConn *redis.Client
+}
+
+func newAuditLog(redisConn *redis.Client) *auditLog {
+	return &auditLog{redisConn: redisConn}
+}
+
+func auditKey(channelID string) string {
+	return "audit:" + channelID
+}
+
+// Record appends an entry to the audit log of channelID. before and after
+// are kept as JSON; nil leaves them out. Failing to record doesn't undo the
+// action, so errors are only logged.
+func (a *auditLog) Record(ctx context.Context, actorID, channelID, action, target string, before, after interface{}) {
+	entry := auditEntry{
+		At:        time.Now(),
+		ActorID:   actorID,
+		ChannelID: channelID,
+		Action:    action,
+		Target:    target,
+	}
+	var err error
+	if before != nil {
+		if entry.Old, err = json.Marshal(before); err != nil {
+			slog.Error("encoding audit entry", logChannelID, channelID, "action", action, "error", err)
+		}
+	}
+	if after != nil {
+		if entry.New, err = json.Marshal(after); err != nil {
+			slog.Error("encoding audit entry", logChannelID, channelID, "action", action, "error", err)
+		}
+	}
+	b, _ := json.Marshal(entry)
+	err = a.redisConn.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditKey(channelID),
+		Values: map[string]interface{}{"entry": b},
+	}).Err()
+	if err != nil {
+		slog.Error("recording audit entry", logChannelID, channelID, logUserID, actorID, "action", action, "error", err)
+	}
+}
+
+// auditedMessage is what the audit log keeps of a message.
+func auditedMessage(message *Message) interface{} {
+	return struct {
+		UserName string `json:"user_name"`
+		Text     string `json:"text"`
+	}{message.UserName, message.Text}
+}
+
+func parseAuditMessage(message redis.XMessage) (*auditEntry, bool) {
+	s, ok := message.Values["entry"].(string)
+	if !ok {
+		return nil, false
+	}
+	var entry auditEntry
+	if json.Unmarshal([]byte(s), &entry) != nil {
+		return nil, false
+	}
+	entry.ID = message.ID
+	return &entry, true
+}
+
+// Search returns up to limit entries of channelID, the newest first, only
+// of action when it is set.
+func (a *auditLog) Search(ctx context.Context, channelID, action string, limit int) ([]*auditEntry, error) {
+	var entries []*auditEntry
+	end := "+"
+	for {
+		messages, err := a.redisConn.XRevRangeN(ctx, auditKey(channelID), end, "-", auditBatchSize).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if message.ID == end {
+				continue
+			}
+			entry, ok := parseAuditMessage(message)
+			if !ok || (action != "" && entry.Action != action) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) == limit {
+				return entries, nil
+			}
+		}
+		if len(messages) < auditBatchSize {
+			return entries, nil
+		}
+		end = messages[len(messages)-1].ID
+	}
+}
+
+// Each calls fn with every entry of channelID, the oldest first, stopping
+// at the first error.
+func (a *auditLog) Each(ctx context.Context, channelID string, fn func(*auditEntry) error) error {
+	start := "-"
+	for {
+		messages, err := a.redisConn.XRangeN(ctx, auditKey(channelID), start, "+", auditBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if message.ID == start {
+				continue
+			}
+			if entry, ok := parseAuditMessage(message); ok {
+				if err = fn(entry); err != nil {
+					return err
+				}
+			}
+		}
+		if len(messages) < auditBatchSize {
+			return nil
+		}
+		start = messages[len(messages)-1].ID
+	}
+}
+
+// HandleAudit shows the audit log of the logged-in channel, filtered by the
+// action query parameter.
+func HandleAudit(audit *auditLog, profiles *profileCache, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardAccess(w, r, moderators, permAudit)
+	if !ok {
+		return
+	}
+	action := r.URL.Query().Get("action")
+	entries, err := audit.Search(r.Context(), user.ChannelID, action, auditPageSize)
+	if err != nil {
+		slog.Error("searching audit log", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var actorIDs []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if !seen[entry.ActorID] {
+			seen[entry.ActorID] = true
+			actorIDs = append(actorIDs, entry.ActorID)
+		}
+	}
+
+	tmpl, err := template.New("audit").Parse(auditHTML)
+	if err != nil {
+		slog.Error("creating audit template", "error", err)
+		return
+	}
+	parsed := bytes.NewBufferString("")
+	err = tmpl.Execute(parsed, struct {
+		Action  string
+		Actions []string
+		Names   map[string]string
+		Actors  map[string]profile
+		Entries []*auditEntry
+	}{
+		Action:  action,
+		Actions: auditActions,
+		Names:   auditActionNames,
+		Actors:  profiles.Lookup(r.Context(), actorIDs),
+		Entries: entries,
+	})
+	if err != nil {
+		slog.Error("rendering audit template", "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(parsed.Bytes())
+}
+
+// HandleAuditExport downloads the whole audit log of the logged-in channel
+// as JSON Lines, the oldest entry first.
+func HandleAuditExport(audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardAccess(w, r, moderators, permAudit)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-`+user.ChannelID+`.jsonl"`)
+	encoder := json.NewEncoder(w)
+	err := audit.Each(r.Context(), user.ChannelID, func(entry *auditEntry) error {
+		return encoder.Encode(entry)
+	})
+	if err != nil {
+		slog.Error("exporting audit log", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+	}
+}
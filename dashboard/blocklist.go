@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// blockedAttemptsKept is how many blocked attempts are kept per channel.
+	blockedAttemptsKept = 100
+	// maxBlockReason is how many characters of the reason of a block are
+	// kept.
+	maxBlockReason = 200
+)
+
+// blockDuration is a choice of the block forms; 0 seconds blocks for good.
+type blockDuration struct {
+	Seconds int
+	Name    string
+}
+
+var blockDurations = []blockDuration{
+	{10 * 60, "10 minutos"},
+	{60 * 60, "1 hora"},
+	{24 * 60 * 60, "1 dia"},
+	{7 * 24 * 60 * 60, "1 semana"},
+	{0, "Para sempre"},
+}
+
+// block keeps a viewer from using TTS on a channel, until ExpiresAt when
+// set. ViewerID is a Twitch user ID or an opaque ID.
+type block struct {
+	ViewerID  string     `json:"viewer_id"`
+	Name      string     `json:"name"`
+	Reason    string     `json:"reason"`
+	BlockedBy string     `json:"blocked_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (b *block) expired() bool {
+	return b.ExpiresAt != nil && time.Now().After(*b.ExpiresAt)
+}
+
+// blockedAttempt is a message refused because its sender is blocked.
+type blockedAttempt struct {
+	ViewerID string    `json:"viewer_id"`
+	Text     string    `json:"text"`
+	At       time.Time `json:"at"`
+}
+
+func blocklistKey(channelID string) string {
+	return "blocklist:" + channelID
+}
+
+func blockedAttemptsKey(channelID string) string {
+	return "blocked-attempts:" + channelID
+}
+
+// newBlock blocks viewerID for duration, or for good when duration is 0.
+func newBlock(viewerID, name, reason, blockedBy string, duration time.Duration) *block {
+	b := &block{
+		ViewerID:  viewerID,
+		Name:      name,
+		Reason:    reason,
+		BlockedBy: blockedBy,
+		CreatedAt: time.Now(),
+	}
+	if duration > 0 {
+		expiresAt := b.CreatedAt.Add(duration)
+		b.ExpiresAt = &expiresAt
+	}
+	return b
+}
+
+func addBlock(ctx context.Context, redisConn *redis.Client, channelID string, b *block) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return redisConn.HSet(ctx, blocklistKey(channelID), b.ViewerID, data).Err()
+}
+
+func removeBlock(ctx context.Context, redisConn *redis.Client, channelID, viewerID string) error {
+	return redisConn.HDel(ctx, blocklistKey(channelID), viewerID).Err()
+}
+
+// findBlock returns the block of the first of viewerIDs that is blocked on
+// channelID, if any. Expired blocks are dropped on the way.
+func findBlock(ctx context.Context, redisConn *redis.Client, channelID string, viewerIDs ...string) (*block, error) {
+	var ids []string
+	for _, id := range viewerIDs {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	values, err := redisConn.HMGet(ctx, blocklistKey(channelID), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var b block
+		if err = json.Unmarshal([]byte(s), &b); err != nil {
+			return nil, err
+		}
+		if b.expired() {
+			_ = removeBlock(ctx, redisConn, channelID, b.ViewerID)
+			continue
+		}
+		return &b, nil
+	}
+	return nil, nil
+}
+
+// listBlocks returns the blocks in force on channelID, the newest first.
+func listBlocks(ctx context.Context, redisConn *redis.Client, channelID string) ([]*block, error) {
+	values, err := redisConn.HGetAll(ctx, blocklistKey(channelID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]*block, 0, len(values))
+	for viewerID, value := range values {
+		var b block
+		if json.Unmarshal([]byte(value), &b) != nil {
+			continue
+		}
+		if b.expired() {
+			_ = removeBlock(ctx, redisConn, channelID, viewerID)
+			continue
+		}
+		blocks = append(blocks, &b)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].CreatedAt.After(blocks[j].CreatedAt) })
+	return blocks, nil
+}
+
+// logBlockedAttempt records that a blocked viewer tried to send text.
+func logBlockedAttempt(ctx context.Context, redisConn *redis.Client, channelID, viewerID, text string) {
+	slog.Info("blocked viewer tried to send a message", logChannelID, channelID, "viewer_id", viewerID, "text", text)
+	data, _ := json.Marshal(blockedAttempt{ViewerID: viewerID, Text: text, At: time.Now()})
+	pipe := redisConn.TxPipeline()
+	pipe.LPush(ctx, blockedAttemptsKey(channelID), data)
+	pipe.LTrim(ctx, blockedAttemptsKey(channelID), 0, blockedAttemptsKept-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("recording blocked attempt", logChannelID, channelID, "viewer_id", viewerID, "error", err)
+	}
+}
+
+// listBlockedAttempts returns up to limit blocked attempts, the newest first.
+func listBlockedAttempts(ctx context.Context, redisConn *redis.Client, channelID string, limit int) ([]blockedAttempt, error) {
+	values, err := redisConn.LRange(ctx, blockedAttemptsKey(channelID), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	attempts := make([]blockedAttempt, 0, len(values))
+	for _, value := range values {
+		var attempt blockedAttempt
+		if json.Unmarshal([]byte(value), &attempt) == nil {
+			attempts = append(attempts, attempt)
+		}
+	}
+	return attempts, nil
+}
+
+// blockFromForm reads the viewer, duration and reason of a block request.
+// The viewer comes either as viewerID, a Twitch user ID or an opaque ID
+// taken as is, or as login, typed by a person: a login, resolved here, or a
+// numeric Twitch user ID.
+func blockFromForm(ctx context.Context, profiles *profileCache, viewerID, login, name, reason, duration, blockedBy string) (*block, error) {
+	viewerID = strings.TrimSpace(viewerID)
+	login = strings.TrimPrefix(strings.TrimSpace(login), "@")
+	if viewerID == "" && login == "" {
+		return nil, fmt.Errorf("informe o viewer")
+	}
+	seconds, err := strconv.Atoi(duration)
+	if err != nil || seconds < 0 {
+		return nil, fmt.Errorf("duração inválida")
+	}
+	if utf8.RuneCountInString(reason) > maxBlockReason {
+		reason = string([]rune(reason)[:maxBlockReason])
+	}
+
+	switch {
+	case viewerID != "":
+	case isTwitchID(login):
+		viewerID = login
+	default:
+		prof, err := profiles.ByLogin(ctx, strings.ToLower(login))
+		if err != nil {
+			return nil, fmt.Errorf("viewer %q não encontrado", login)
+		}
+		viewerID, name = prof.ID, prof.DisplayName
+	}
+	if name == "" {
+		name = viewerID
+		if login != "" {
+			name = login
+		}
+	}
+	return newBlock(viewerID, name, reason, blockedBy, time.Duration(seconds)*time.Second), nil
+}
+
+// isTwitchID tells numeric Twitch user IDs apart.
+func isTwitchID(id string) bool {
+	return id != "" && !isOpaqueID(id)
+}
+
+// HandleBlocklist blocks and unblocks viewers from the dashboard.
+func HandleBlocklist(redisConn *redis.Client, profiles *profileCache, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permBlocklist)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	back := "/"
+	if r.PostFormValue("back") == "history" {
+		back = "/history"
+	}
+
+	if r.PostFormValue("action") == "unblock" {
+		viewerID := r.PostFormValue("viewer")
+		old, err := findBlock(ctx, redisConn, user.ChannelID, viewerID)
+		if err == nil {
+			err = removeBlock(ctx, redisConn, user.ChannelID, viewerID)
+		}
+		if err != nil {
+			slog.Error("removing block", logChannelID, user.ChannelID, logUserID, user.UserID, "viewer_id", viewerID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if old != nil {
+			audit.Record(ctx, user.UserID, user.ChannelID, auditUnblock, viewerID, old, nil)
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	b, err := blockFromForm(ctx, profiles, r.PostFormValue("viewer"), r.PostFormValue("login"), r.PostFormValue("name"), r.PostFormValue("reason"), r.PostFormValue("duration"), user.UserID)
+	if err != nil {
+		addFlash(w, r, "Viewer não bloqueado: "+err.Error()+".")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err = addBlock(ctx, redisConn, user.ChannelID, b); err != nil {
+		slog.Error("adding block", logChannelID, user.ChannelID, logUserID, user.UserID, "viewer_id", b.ViewerID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit.Record(ctx, user.UserID, user.ChannelID, auditBlock, b.ViewerID, nil, b)
+	slog.Info("viewer blocked", logChannelID, user.ChannelID, logUserID, user.UserID, "viewer_id", b.ViewerID, "viewer_name", b.Name)
+	addFlash(w, r, b.Name+" bloqueado.")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// HandleBlocklistAPI lets the broadcaster and the moderators of a channel
+// manage its blocklist from the extension, authenticated by its JWT:
+//
+//	GET    /api/blocklist                 the blocks in force
+//	POST   /api/blocklist                 {"viewer": <id> or "login": ..., "duration_seconds": ..., "reason": ...}
+//	DELETE /api/blocklist?viewer=<id>     lifts a block
+func HandleBlocklistAPI(redisConn *redis.Client, profiles *profileCache, audit *auditLog, w http.ResponseWriter, r *http.Request) {
+	extensionCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	claims, err := extensionClaims(r)
+	if err != nil {
+		slog.Warn("invalid extension jwt", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	channelID, _ := claims["channel_id"].(string)
+	role, _ := claims["role"].(string)
+	if channelID == "" || (role != roleBroadcaster && role != roleModerator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// moderadores só aparecem pelo opaque id se não compartilharam a identidade
+	blockedBy, _ := claims["user_id"].(string)
+	if blockedBy == "" {
+		blockedBy, _ = claims["opaque_user_id"].(string)
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			Viewer          string `json:"viewer"`
+			Login           string `json:"login"`
+			Name            string `json:"name"`
+			Reason          string `json:"reason"`
+			DurationSeconds int    `json:"duration_seconds"`
+		}
+		if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+			http.Error(w, "Pedido inválido.", http.StatusBadRequest)
+			return
+		}
+		b, err := blockFromForm(ctx, profiles, request.Viewer, request.Login, request.Name, request.Reason, strconv.Itoa(request.DurationSeconds), blockedBy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = addBlock(ctx, redisConn, channelID, b); err != nil {
+			slog.Error("adding block", logChannelID, channelID, logUserID, blockedBy, "viewer_id", b.ViewerID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		audit.Record(ctx, blockedBy, channelID, auditBlock, b.ViewerID, nil, b)
+		slog.Info("viewer blocked", logChannelID, channelID, logUserID, blockedBy, "role", role, "viewer_id", b.ViewerID)
+	case http.MethodDelete:
+		viewerID := r.URL.Query().Get("viewer")
+		old, err := findBlock(ctx, redisConn, channelID, viewerID)
+		if err == nil {
+			err = removeBlock(ctx, redisConn, channelID, viewerID)
+		}
+		if err != nil {
+			slog.Error("removing block", logChannelID, channelID, logUserID, blockedBy, "viewer_id", viewerID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if old != nil {
+			audit.Record(ctx, blockedBy, channelID, auditUnblock, viewerID, old, nil)
+		}
+		slog.Info("viewer unblocked", logChannelID, channelID, logUserID, blockedBy, "role", role, "viewer_id", viewerID)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	blocks, err := listBlocks(ctx, redisConn, channelID)
+	if err != nil {
+		slog.Error("listing blocks", logChannelID, channelID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Blocks []*block `json:"blocks"`
+	}{blocks})
+}
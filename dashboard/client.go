@@ -6,16 +6,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -29,7 +34,12 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 4096
+
+	// Time allowed for the overlay to say hello. Until then nothing is
+	// sent, as it isn't known yet whether it understands envelopes;
+	// version 0 overlays never say hello.
+	helloWait = 3 * time.Second
 )
 
 var (
@@ -37,37 +47,104 @@ var (
 	space   = []byte{' '}
 )
 
+// Client roles: the overlay in OBS, or the preview embedded in the
+// dashboard.
+const (
+	roleOverlay = "overlay"
+	rolePreview = "preview"
+)
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	id string
 
+	// roleOverlay or rolePreview.
+	role string
+
 	hub *Hub
 
 	// The websocket connection.
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan *Message
+	send chan *Envelope
 
 	// RabbitMQ connection and channel
 	amqpMutex sync.Mutex
 	amqpConn  *amqp.Connection
 	amqpChan  *amqp.Channel
+
+	// Channel settings at the time the overlay connected.
+	settings overlaySettings
+
+	// Closed when the overlay says hello.
+	greeted   chan struct{}
+	greetOnce sync.Once
+
+	// Overlay state, as reported by the overlay itself.
+	stateMutex   sync.RWMutex
+	version      int
+	capabilities map[string]bool
+	audioFormat  string
+	queueLength  int
+	connectedAt  time.Time
+	lastPing     time.Time
 }
 
+// capInlineAudio overlays play the audio sent inside the Message instead of
+// fetching its audio_url.
+const capInlineAudio = "inline_audio"
+
 type ttsResponse struct {
 	Success bool   `json:"success"`
 	AudioID string `json:"audio_id"`
 	Reason  string `json:"reason"`
 }
 
-func (c *Client) TTS(text string) (string, error) {
+// TTS asks the voxfala worker to synthesize text with voice and returns the
+// ID of the audio it stored in Redis. requestID goes along as the AMQP
+// correlation ID, so the worker can log it, and the trace context of ctx in
+// the message headers, so it can continue the trace. It gives up when ctx is
+// done, releasing the connection for the next message.
+func (c *Client) TTS(ctx context.Context, requestID, text, voice string) (string, error) {
 	c.amqpMutex.Lock()
 	defer c.amqpMutex.Unlock()
+	if c.amqpChan == nil {
+		return "", errors.New("not connected to RabbitMQ")
+	}
+	return c.tts(ctx, c.amqpChan, requestID, text, voice)
+}
+
+// TestTTS is TTS on an AMQP channel of its own, so test messages never hold
+// up the messages of the viewers.
+func (c *Client) TestTTS(ctx context.Context, requestID, text, voice string) (string, error) {
+	if c.amqpConn == nil {
+		return "", errors.New("not connected to RabbitMQ")
+	}
+	amqpChan, err := c.amqpConn.Channel()
+	if err != nil {
+		return "", fmt.Errorf("open channel: %w", err)
+	}
+	defer amqpChan.Close()
+	return c.tts(ctx, amqpChan, requestID, text, voice)
+}
+
+func (c *Client) tts(ctx context.Context, amqpChan *amqp.Channel, requestID, text, voice string) (audioID string, err error) {
+	logger := slog.With(logRequestID, requestID, logChannelID, c.id)
+	ctx, span := tracer.Start(ctx, "ms.vox_fala send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingDestinationName("ms.vox_fala"),
+			semconv.MessagingMessageConversationID(requestID),
+			attribute.String("tts.voice", voice),
+		),
+	)
+	defer func() { endSpan(span, err) }()
 
 	// start model response consumer
 	consumerID := uuid.New().String()
-	responseCh, err := c.amqpChan.Consume(
+	responseCh, err := amqpChan.Consume(
 		"amq.rabbitmq.reply-to", // queue
 		consumerID,              // consumer
 		true,                    // auto-ack
@@ -80,21 +157,24 @@ func (c *Client) TTS(text string) (string, error) {
 		return "", fmt.Errorf("failed to register the response consumer: %w", err)
 	}
 	defer func() {
-		if err := c.amqpChan.Cancel(consumerID, false); err != nil {
-			log.Println("failed to cancel the response consumer:", err)
+		if err := amqpChan.Cancel(consumerID, false); err != nil {
+			logger.Warn("failed to cancel the response consumer", "error", err)
 		}
 	}()
 
 	requestBody, _ := json.Marshal(struct {
 		Action string `json:"action"`
 		Text   string `json:"text"`
+		Voice  string `json:"voice,omitempty"`
 	}{
 		Action: "tts",
 		Text:   text,
+		Voice:  voice,
 	})
 	// send tts request to MQ
-	correlationID := uuid.New().String()
-	err = c.amqpChan.Publish(
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeaders(headers))
+	err = amqpChan.Publish(
 		"",            // exchange
 		"ms.vox_fala", // routing key
 		false,         // mandatory
@@ -104,30 +184,98 @@ func (c *Client) TTS(text string) (string, error) {
 			Body:          requestBody,
 			DeliveryMode:  amqp.Persistent,
 			Expiration:    "60000",
-			CorrelationId: correlationID,
+			CorrelationId: requestID,
 			ReplyTo:       "amq.rabbitmq.reply-to",
+			Headers:       headers,
 		})
 	if err != nil {
 		return "", fmt.Errorf("publish message: %w", err)
 	}
 
+	logger.Debug("tts request published", "voice", voice)
+	span.AddEvent("published")
+	published := time.Now()
 	timeoutTimer := time.NewTimer(5 * time.Minute)
 	defer timeoutTimer.Stop()
 	var responseBody []byte
 	select {
 	case d := <-responseCh:
-		// assert correlationID == d.CorrelationId
+		if d.CorrelationId != "" && d.CorrelationId != requestID {
+			logger.Warn("tts reply with another correlation id", "correlation_id", d.CorrelationId)
+		}
 		responseBody = d.Body
+		amqpRoundTrip.WithLabelValues("reply").Observe(time.Since(published).Seconds())
+		logger.Debug("tts reply received", "duration", time.Since(published))
 		break
 	case <-timeoutTimer.C:
+		amqpRoundTrip.WithLabelValues("timeout").Observe(time.Since(published).Seconds())
 		return "", errors.New("timeout")
+	case <-ctx.Done():
+		amqpRoundTrip.WithLabelValues("timeout").Observe(time.Since(published).Seconds())
+		return "", ctx.Err()
 	}
 	var response *ttsResponse
 	err = json.Unmarshal(responseBody, &response)
 	if err != nil {
 		return "", fmt.Errorf("json unmarshal: %w", err)
 	}
-	return "https://vox-twitch.monique.dev/ttsPlay/" + response.AudioID, nil
+	if !response.Success {
+		logger.Warn("tts worker failed", "reason", response.Reason)
+		span.SetAttributes(attribute.String("tts.failure_reason", response.Reason))
+		return "", fmt.Errorf("tts worker: %s", response.Reason)
+	}
+	return response.AudioID, nil
+}
+
+func (c *Client) hello(version int, hello *helloPayload) {
+	c.stateMutex.Lock()
+	c.version = version
+	c.capabilities = make(map[string]bool, len(hello.Capabilities))
+	for _, capability := range hello.Capabilities {
+		c.capabilities[capability] = true
+	}
+	c.audioFormat = hello.AudioFormat
+	c.stateMutex.Unlock()
+	c.greetOnce.Do(func() { close(c.greeted) })
+}
+
+func (c *Client) setQueueLength(length int) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	c.queueLength = length
+	if c.role == roleOverlay {
+		overlayQueueLength.WithLabelValues(c.id).Set(float64(length))
+	}
+}
+
+func (c *Client) ping() {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	c.lastPing = time.Now()
+}
+
+// ProtocolVersion is the protocol version the overlay said hello with.
+func (c *Client) ProtocolVersion() int {
+	c.stateMutex.RLock()
+	defer c.stateMutex.RUnlock()
+	return c.version
+}
+
+// Supports tells whether the overlay announced capability.
+func (c *Client) Supports(capability string) bool {
+	c.stateMutex.RLock()
+	defer c.stateMutex.RUnlock()
+	return c.capabilities[capability]
+}
+
+// AudioFormat is the format the overlay prefers for inline audio.
+func (c *Client) AudioFormat() audioFormat {
+	c.stateMutex.RLock()
+	defer c.stateMutex.RUnlock()
+	if format, ok := audioFormats[c.audioFormat]; ok {
+		return format
+	}
+	return audioFormats[defaultAudioFormat]
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -147,13 +295,13 @@ func (c *Client) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				slog.Warn("websocket closed unexpectedly", logChannelID, c.id, "role", c.role, "error", err)
 			}
 			break
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		// impossibru!
-		log.Fatalln("unexpected message received:", string(message))
+		envelope, err := decodeEnvelope(message)
+		c.hub.inbound <- &inboundMessage{client: c, envelope: envelope, err: err}
 	}
 }
 
@@ -164,21 +312,48 @@ func (c *Client) readPump() {
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
+	helloTimer := time.NewTimer(helloWait)
 	defer func() {
 		ticker.Stop()
+		helloTimer.Stop()
 		c.conn.Close()
 	}()
+	// segura o que chegar antes do hello
+	greeted, helloTimeout := c.greeted, helloTimer.C
+	var held []*Envelope
+	release := func() error {
+		greeted, helloTimeout = nil, nil
+		for _, envelope := range held {
+			if err := c.write(envelope); err != nil {
+				return err
+			}
+		}
+		held = nil
+		return nil
+	}
 	for {
 		select {
-		case message, ok := <-c.send:
+		case envelope, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+			if greeted != nil {
+				held = append(held, envelope)
+			} else if err := c.write(envelope); err != nil {
+				return
+			}
 
-			if err := c.conn.WriteJSON(message); err != nil {
+		case <-greeted:
+			if err := release(); err != nil {
+				return
+			}
+
+		// version 0 overlays never say hello
+		case <-helloTimeout:
+			if err := release(); err != nil {
 				return
 			}
 
@@ -190,3 +365,18 @@ func (c *Client) writePump() {
 		}
 	}
 }
+
+// write sends envelope to the overlay, in the version of the protocol it
+// understands.
+func (c *Client) write(envelope *Envelope) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	// version 0 overlays only understand bare messages
+	var v interface{} = envelope
+	if c.ProtocolVersion() == 0 {
+		if envelope.Type != typeMessage {
+			return nil
+		}
+		v = envelope.Payload
+	}
+	return c.conn.WriteJSON(v)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+const csrfTokenKey = "csrf-token"
+
+// csrfToken returns the CSRF token of the session, creating it on first
+// use. Every dashboard form sends it back as csrf_token.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, _ := cookieStore.Get(r, oauthSessionName)
+	if token, ok := session.Values[csrfTokenKey].(string); ok && token != "" {
+		return token, nil
+	}
+	var tokenBytes [32]byte
+	if _, err := rand.Read(tokenBytes[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes[:])
+	session.Values[csrfTokenKey] = token
+	return token, session.Save(r, w)
+}
+
+// validCSRF tells whether the form posted in r carries the session's CSRF
+// token.
+func validCSRF(r *http.Request) bool {
+	session, err := cookieStore.Get(r, oauthSessionName)
+	if err != nil {
+		return false
+	}
+	token, ok := session.Values[csrfTokenKey].(string)
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue("csrf_token"))) == 1
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// dashboardPost checks what every form of the dashboard needs: a POST, from
+// a logged-in user whose role on the channel allows perm, carrying the
+// session's CSRF token. It returns the user, or false after having answered
+// the request.
+func dashboardPost(w http.ResponseWriter, r *http.Request, moderators *moderatorList, perm permission) (dashboardUser, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return dashboardUser{}, false
+	}
+	user, ok := dashboardAccess(w, r, moderators, perm)
+	if !ok {
+		return user, false
+	}
+	if !validCSRF(r) {
+		slog.Warn("invalid csrf token", logChannelID, user.ChannelID, logUserID, user.UserID, "path", r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return dashboardUser{}, false
+	}
+	return user, true
+}
+
+// dashboardAccess checks that whoever is logged in may do perm on the
+// channel they are managing. It returns the user, or false after having
+// answered the request.
+func dashboardAccess(w http.ResponseWriter, r *http.Request, moderators *moderatorList, perm permission) (dashboardUser, bool) {
+	user, err := moderators.User(r)
+	switch {
+	case err == errNoSession:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return user, false
+	case err == errNotModerator || err == errChannelUnavailable:
+		slog.Warn("dashboard access denied", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return user, false
+	case err != nil:
+		slog.Error("loading dashboard user", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return user, false
+	case !user.Can(perm):
+		slog.Warn("dashboard permission denied", logChannelID, user.ChannelID, logUserID, user.UserID, "role", user.Role, "permission", perm)
+		w.WriteHeader(http.StatusForbidden)
+		return user, false
+	}
+	return user, true
+}
+
+// addFlash leaves a message for the next render of the dashboard.
+func addFlash(w http.ResponseWriter, r *http.Request, message string) {
+	session, _ := cookieStore.Get(r, oauthSessionName)
+	session.AddFlash(message)
+	if err := session.Save(r, w); err != nil {
+		slog.Error("saving session", "error", err)
+	}
+}
+
+// HandleSaveSettings saves the settings form of the dashboard and tells the
+// channel's overlay about them. Moderators only get to change the filtered
+// words.
+func HandleSaveSettings(hub *Hub, redisConn *redis.Client, extConfig *extensionConfig, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permFilters)
+	if !ok {
+		return
+	}
+	old, err := loadSettings(r.Context(), redisConn, user.ChannelID)
+	if err != nil {
+		slog.Error("loading settings", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var settings *channelSettings
+	if user.Can(permSettings) {
+		settings, err = settingsFromForm(r)
+	} else {
+		filtered := *old
+		filtered.Filters = filtersFromForm(r)
+		settings, err = &filtered, filtered.validate()
+	}
+	if err != nil {
+		addFlash(w, r, "Configurações não salvas: "+err.Error()+".")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err = applySettings(r.Context(), hub, redisConn, extConfig, user.ChannelID, settings); err != nil {
+		slog.Error("applying settings", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r.Context(), user.UserID, user.ChannelID, auditSettings, "", old, settings)
+	slog.Info("settings saved", logChannelID, user.ChannelID, logUserID, user.UserID, "settings", *settings)
+	addFlash(w, r, "Configurações salvas.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// applySettings saves the settings of channelID and passes them on to its
+// overlay and to the config page of the extension.
+func applySettings(ctx context.Context, hub *Hub, redisConn *redis.Client, extConfig *extensionConfig, channelID string, settings *channelSettings) error {
+	if err := saveSettings(ctx, redisConn, channelID, settings); err != nil {
+		return err
+	}
+	hub.notify <- &channelEnvelope{channelID: channelID, envelope: newEnvelope(typeSettings, settings.Overlay())}
+	if extConfig.Enabled() {
+		// o Redis continua sendo a fonte da verdade, então só registramos a falha
+		if err := extConfig.Set(ctx, channelID, settings); err != nil {
+			slog.Warn("saving extension configuration", logChannelID, channelID, "error", err)
+		}
+	}
+	return nil
+}
+
+// HandleApproval approves or rejects a message waiting in the approval
+// queue of the channel.
+func HandleApproval(hub *Hub, redisConn *redis.Client, history *messageHistory, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permQueue)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	message, err := takePending(ctx, redisConn, user.ChannelID, r.PostFormValue("id"))
+	switch {
+	case err == redis.Nil:
+		addFlash(w, r, "Essa mensagem já foi aprovada ou rejeitada.")
+	case err != nil:
+		slog.Error("taking pending message", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case r.PostFormValue("action") == "approve":
+		if n, err := redisConn.Exists(ctx, message.AudioID).Result(); err != nil || n == 0 {
+			history.SetOutcome(ctx, user.ChannelID, message.ID, outcomeFailed)
+			addFlash(w, r, "O áudio dessa mensagem já expirou.")
+			break
+		}
+		deliver(ctx, hub, redisConn, message)
+		history.SetOutcome(ctx, user.ChannelID, message.ID, outcomeDelivered)
+		audit.Record(ctx, user.UserID, user.ChannelID, auditApprove, message.ID, nil, auditedMessage(message))
+		slog.Info("message approved", logRequestID, message.RequestID, logChannelID, user.ChannelID,
+			logMessageID, message.ID, "moderator_id", user.UserID)
+	default:
+		history.SetOutcome(ctx, user.ChannelID, message.ID, outcomeRejected)
+		audit.Record(ctx, user.UserID, user.ChannelID, auditReject, message.ID, nil, auditedMessage(message))
+		slog.Info("message rejected", logRequestID, message.RequestID, logChannelID, user.ChannelID,
+			logMessageID, message.ID, "moderator_id", user.UserID)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleLayerThemes saves or deletes a layout of the overlay, so the layer
+// URL can refer to it by name instead of carrying every parameter.
+func HandleLayerThemes(redisConn *redis.Client, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permSettings)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	name := r.PostFormValue("name")
+	var old *layerTheme
+	if theme, err := loadLayerTheme(ctx, redisConn, user.ChannelID, name); err == nil {
+		old = &theme
+	}
+	if r.PostFormValue("action") == "delete" {
+		if err := deleteLayerTheme(ctx, redisConn, user.ChannelID, name); err != nil {
+			slog.Error("deleting layer theme", logChannelID, user.ChannelID, logUserID, user.UserID, "theme", name, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if old != nil {
+			audit.Record(ctx, user.UserID, user.ChannelID, auditLayerThemeDelete, name, old, nil)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	theme := defaultLayerTheme()
+	err := theme.apply(r.PostForm)
+	// checkbox desmarcado não vai no form
+	theme.ShowAvatar = r.PostFormValue("show-avatar") == "true"
+	if err == nil {
+		err = saveLayerTheme(ctx, redisConn, user.ChannelID, name, theme)
+	}
+	if err != nil {
+		addFlash(w, r, "Tema não salvo: "+err.Error()+".")
+	} else {
+		audit.Record(ctx, user.UserID, user.ChannelID, auditLayerThemeSave, name, old, theme)
+		addFlash(w, r, "Tema "+name+" salvo.")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
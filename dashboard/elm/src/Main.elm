@@ -14,7 +14,7 @@ import Time
 -- MAIN
 
 
-main : Program Float Model Msg
+main : Program Flags Model Msg
 main =
     Browser.element
         { init = init
@@ -64,17 +64,35 @@ type alias Card =
 type alias Model =
     { cards : List Card
     , audios : List String
-    , innerHeight : Float
+    , flags : Flags
+    }
+
+
+{-| Layout chosen by the streamer in the layer URL.
+-}
+type alias Flags =
+    { innerHeight : Float
+    , position : String
+    , maxCards : Int
+    , cardLifetime : Int
+    , showAvatar : Bool
+    }
+
+
+type alias Emote =
+    { url : String
+    , animated : Bool
+    , provider : String
     }
 
 
 type alias Emotes =
-    Dict String String
+    Dict String Emote
 
 
-init : Float -> ( Model, Cmd Msg )
-init innerHeight =
-    ( Model [] [] innerHeight, Cmd.none )
+init : Flags -> ( Model, Cmd Msg )
+init flags =
+    ( Model [] [] flags, Cmd.none )
 
 
 
@@ -117,7 +135,7 @@ update msg model =
                             Animation.interrupt
                                 [ Animation.to [ Animation.translate (percent 0) (px 0) ]
                                 ]
-                                (Animation.style [ Animation.translate (percent 0) (px model.innerHeight) ])
+                                (Animation.style [ Animation.translate (percent 0) (px model.flags.innerHeight) ])
 
                         newCard =
                             [ Card ws.username ws.text ws.emotes ws.user_picture ws.audio_url newAnimation ]
@@ -135,9 +153,17 @@ update msg model =
 
                             else
                                 Cmd.none
+
+                        -- os cards mais antigos saem para caber o novo
+                        cards =
+                            if model.flags.maxCards > 0 then
+                                List.drop (List.length model.cards + 1 - model.flags.maxCards) model.cards
+
+                            else
+                                model.cards
                     in
                     ( { model
-                        | cards = model.cards ++ newCard
+                        | cards = cards ++ newCard
                         , audios = model.audios ++ newAudio
                       }
                     , cmd
@@ -158,8 +184,8 @@ update msg model =
                                 { card
                                     | animStyle =
                                         Animation.queue
-                                            [ Animation.wait (Time.millisToPosix <| 3 * 1000)
-                                            , Animation.to [ Animation.translate (percent 115) (percent 0) ]
+                                            [ Animation.wait (Time.millisToPosix <| model.flags.cardLifetime * 1000)
+                                            , Animation.to [ Animation.translate (percent (exitOffset model.flags.position)) (percent 0) ]
                                             , Animation.Messenger.send AnimationDone
                                             ]
                                             card.animStyle
@@ -201,18 +227,45 @@ subscriptions model =
 -- VIEW
 
 
-cardView : Card -> Html Msg
-cardView card =
+cardView : Flags -> Card -> Html Msg
+cardView flags card =
     div
         (Animation.render card.animStyle
             ++ [ class "content" ]
         )
-        [ div [ class "user-picture" ] [ img [ src card.user_picture ] [] ]
-        , div [ class "container" ]
-            [ div [ class "username" ] [ text <| card.username ++ " disse:" ]
-            , div [ class "text" ] (filterEmote card.emotes card.text)
-            ]
-        ]
+        ((if flags.showAvatar then
+            [ userPictureView card.user_picture ]
+
+          else
+            []
+         )
+            ++ [ div [ class "container" ]
+                    [ div [ class "username" ] [ text <| card.username ++ " disse:" ]
+                    , div [ class "text" ] (filterEmote card.emotes card.text)
+                    ]
+               ]
+        )
+
+
+{-| Cards leave towards the closest side of the screen.
+-}
+exitOffset : String -> Float
+exitOffset position =
+    if String.endsWith "left" position then
+        -115
+
+    else
+        115
+
+
+userPictureView : String -> Html msg
+userPictureView url =
+    if String.isEmpty url then
+        -- viewer que não compartilhou a identidade
+        div [ class "user-picture placeholder" ] [ text "?" ]
+
+    else
+        div [ class "user-picture" ] [ img [ src url ] [] ]
 
 
 filterEmote : Emotes -> String -> List (Html msg)
@@ -224,19 +277,14 @@ filterEmote emotes text =
 
 mapUrl : Emotes -> String -> Html msg
 mapUrl emotes word =
-    let
-        urlTemplate =
-            "https://cdn.betterttv.net/emote/"
-    in
     Dict.get word emotes
-        |> Maybe.map (\w -> urlTemplate ++ w ++ "/1x")
-        |> Maybe.map (\url -> img [ src url ] [])
+        |> Maybe.map (\emote -> img [ src emote.url, alt word, title word, class "emote" ] [])
         |> Maybe.withDefault (text (" " ++ word ++ " "))
 
 
 view : Model -> Html Msg
 view model =
-    div [ class "main" ] (List.map cardView model.cards)
+    div [ class "main" ] (List.map (cardView model.flags) model.cards)
 
 
 
@@ -249,6 +297,14 @@ websocketMessageDecoder =
         (D.field "client_id" D.string)
         (D.field "audio_url" D.string)
         (D.field "text" D.string)
-        (D.field "emotes" (D.dict D.string))
+        (D.field "emotes" (D.oneOf [ D.dict emoteDecoder, D.null Dict.empty ]))
         (D.field "username" D.string)
         (D.field "user_picture" D.string)
+
+
+emoteDecoder : D.Decoder Emote
+emoteDecoder =
+    D.map3 Emote
+        (D.field "url" D.string)
+        (D.field "animated" D.bool)
+        (D.field "provider" D.string)
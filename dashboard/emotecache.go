@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// globalEmotes is the emoteCache key of the emotes available everywhere.
+const globalEmotes = ""
+
+var emoteFetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "vox_twitch_emote_fetch_failures_total",
+	Help: "The total number of failed emote fetches, by provider",
+}, []string{"provider", "scope"},
+)
+
+// emoteCache keeps the global emotes and those of each channel for ttl.
+// Stale entries keep being served while they are refreshed in background,
+// so only the very first message of a channel waits for the providers.
+type emoteCache struct {
+	ttl time.Duration
+
+	// newClient creates the helix client used by the twitch provider.
+	newClient func() (*helix.Client, error)
+
+	mu       sync.Mutex
+	entries  map[string]*emoteCacheEntry
+	inflight map[string]chan struct{}
+}
+
+type emoteCacheEntry struct {
+	emotes    Emotes
+	fetchedAt time.Time
+}
+
+func newEmoteCache(ttl time.Duration, newClient func() (*helix.Client, error)) *emoteCache {
+	return &emoteCache{
+		ttl:       ttl,
+		newClient: newClient,
+		entries:   make(map[string]*emoteCacheEntry),
+		inflight:  make(map[string]chan struct{}),
+	}
+}
+
+// Get returns the emotes usable on channelID.
+func (c *emoteCache) Get(channelID string) Emotes {
+	emotes := make(Emotes)
+	emotes.merge(c.get(globalEmotes))
+	emotes.merge(c.get(channelID))
+	return emotes
+}
+
+// Warm starts fetching the emotes of channelID, if not cached yet.
+func (c *emoteCache) Warm(channelID string) {
+	for _, key := range []string{globalEmotes, channelID} {
+		c.mu.Lock()
+		_, found := c.entries[key]
+		c.mu.Unlock()
+		if !found {
+			go c.refresh(key)
+		}
+	}
+}
+
+func (c *emoteCache) get(key string) Emotes {
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	var emotes Emotes
+	if found {
+		emotes = entry.emotes
+		if time.Since(entry.fetchedAt) > c.ttl {
+			if done, started := c.start(key); started {
+				go c.finish(key, done)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if !found {
+		return c.refresh(key)
+	}
+	return emotes
+}
+
+// Refresh fetches the emotes of channelID right away, replacing the cached
+// ones. Use globalEmotes to refresh the global emotes.
+func (c *emoteCache) Refresh(channelID string) Emotes {
+	return c.refresh(channelID)
+}
+
+// refresh fetches the emotes of key, or waits for the fetch already in
+// flight, so the providers are asked only once.
+func (c *emoteCache) refresh(key string) Emotes {
+	c.mu.Lock()
+	done, started := c.start(key)
+	c.mu.Unlock()
+	if started {
+		return c.finish(key, done)
+	}
+
+	<-done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, found := c.entries[key]; found {
+		return entry.emotes
+	}
+	return nil
+}
+
+// start marks a fetch of key in flight, unless there is one already. done
+// is closed when the fetch ends. The caller holds mu.
+func (c *emoteCache) start(key string) (done chan struct{}, started bool) {
+	if done, found := c.inflight[key]; found {
+		return done, false
+	}
+	done = make(chan struct{})
+	c.inflight[key] = done
+	return done, true
+}
+
+// finish fetches the emotes of key for the fetch started with done, and
+// caches them.
+func (c *emoteCache) finish(key string, done chan struct{}) Emotes {
+	emotes, ok := c.fetch(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	defer close(done)
+	entry, found := c.entries[key]
+	if !found {
+		entry = &emoteCacheEntry{}
+		c.entries[key] = entry
+	}
+	if ok || !found {
+		entry.emotes, entry.fetchedAt = emotes, time.Now()
+	} else {
+		// mantém os emotes antigos e tenta de novo daqui a pouco
+		entry.fetchedAt = time.Now().Add(-c.ttl + time.Minute)
+	}
+	return entry.emotes
+}
+
+// fetch asks every provider for the emotes of key. ok is false when any of
+// them failed; whatever the others returned is still used.
+func (c *emoteCache) fetch(key string) (emotes Emotes, ok bool) {
+	client, err := c.newClient()
+	if err != nil {
+		slog.Error("creating helix client", "error", err)
+	}
+
+	scope := "channel"
+	if key == globalEmotes {
+		scope = "global"
+	}
+	// roda em background, então começa um trace próprio
+	ctx, span := tracer.Start(context.Background(), "emotes.fetch", trace.WithAttributes(
+		attribute.String("emotes.scope", scope),
+		attribute.String(logChannelID, key),
+	))
+	defer span.End()
+	emotes, ok = make(Emotes), true
+	for _, provider := range emoteProviders(client) {
+		providerCtx, providerSpan := tracer.Start(ctx, "emotes.fetch "+provider.Name())
+		var found Emotes
+		if scope == "global" {
+			found, err = provider.Global(providerCtx)
+		} else {
+			found, err = provider.Channel(providerCtx, key)
+		}
+		providerSpan.SetAttributes(attribute.Int("emotes.count", len(found)))
+		endSpan(providerSpan, err)
+		if err != nil {
+			slog.Warn("fetching emotes", "provider", provider.Name(), "scope", scope, logChannelID, key, "error", err)
+			emoteFetchFailures.With(prometheus.Labels{"provider": provider.Name(), "scope": scope}).Inc()
+			ok = false
+		}
+		emotes.merge(found)
+	}
+	return emotes, ok
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicklaw5/helix"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Emote is an emote already resolved to the image the overlay shows.
+type Emote struct {
+	URL      string `json:"url"`
+	Animated bool   `json:"animated"`
+	Provider string `json:"provider"`
+}
+
+// Emotes maps emote codes, as typed by viewers, to their images.
+type Emotes map[string]Emote
+
+// emoteProvider is a service that hosts emotes, Twitch itself included.
+type emoteProvider interface {
+	Name() string
+	Global(ctx context.Context) (Emotes, error)
+	Channel(ctx context.Context, channelID string) (Emotes, error)
+}
+
+// emoteProviders returns every provider in increasing order of precedence:
+// Twitch's own emotes win.
+func emoteProviders(client *helix.Client) []emoteProvider {
+	return []emoteProvider{
+		frankerFaceZ{},
+		betterTTV{},
+		sevenTV{},
+		twitchEmotes{client},
+	}
+}
+
+var emoteHTTPClient = &http.Client{
+	Timeout:   5 * time.Second,
+	Transport: otelhttp.NewTransport(newInstrumentedTransport("emotes", nil)),
+}
+
+func (e Emotes) merge(other Emotes) {
+	for code, emote := range other {
+		e[code] = emote
+	}
+}
+
+// getJSON decodes the response of url into v. A 404 leaves v untouched:
+// providers answer that for channels that never signed up.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := emoteHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+}
+
+// https adds the scheme to the protocol-relative URLs some providers use.
+func https(url string) string {
+	if strings.HasPrefix(url, "//") {
+		return "https:" + url
+	}
+	return url
+}
+
+// BetterTTV - https://betterttv.com/developers/api
+
+type betterTTV struct{}
+
+type betterTTVEmote struct {
+	ID        string `json:"id"`
+	Code      string `json:"code"`
+	ImageType string `json:"imageType"`
+	Animated  bool   `json:"animated"`
+}
+
+func (betterTTV) Name() string { return "bttv" }
+
+func (p betterTTV) Global(ctx context.Context) (Emotes, error) {
+	var global []betterTTVEmote
+	if err := getJSON(ctx, "https://api.betterttv.net/3/cached/emotes/global", &global); err != nil {
+		return nil, err
+	}
+	return p.emotes(global), nil
+}
+
+func (p betterTTV) Channel(ctx context.Context, channelID string) (Emotes, error) {
+	var user struct {
+		ChannelEmotes []betterTTVEmote `json:"channelEmotes"`
+		SharedEmotes  []betterTTVEmote `json:"sharedEmotes"`
+	}
+	if err := getJSON(ctx, "https://api.betterttv.net/3/cached/users/twitch/"+channelID, &user); err != nil {
+		return nil, err
+	}
+	return p.emotes(append(user.ChannelEmotes, user.SharedEmotes...)), nil
+}
+
+func (p betterTTV) emotes(list []betterTTVEmote) Emotes {
+	emotes := make(Emotes, len(list))
+	for _, emote := range list {
+		emotes[emote.Code] = Emote{
+			URL:      "https://cdn.betterttv.net/emote/" + emote.ID + "/1x",
+			Animated: emote.Animated || emote.ImageType == "gif",
+			Provider: p.Name(),
+		}
+	}
+	return emotes
+}
+
+// FrankerFaceZ - https://api.frankerfacez.com/docs/
+
+type frankerFaceZ struct{}
+
+type frankerFaceZSet struct {
+	Emoticons []struct {
+		Name     string            `json:"name"`
+		URLs     map[string]string `json:"urls"`
+		Animated map[string]string `json:"animated"`
+	} `json:"emoticons"`
+}
+
+func (frankerFaceZ) Name() string { return "ffz" }
+
+func (p frankerFaceZ) Global(ctx context.Context) (Emotes, error) {
+	var global struct {
+		DefaultSets []int                      `json:"default_sets"`
+		Sets        map[string]frankerFaceZSet `json:"sets"`
+	}
+	if err := getJSON(ctx, "https://api.frankerfacez.com/v1/set/global", &global); err != nil {
+		return nil, err
+	}
+	sets := make([]frankerFaceZSet, 0, len(global.DefaultSets))
+	for _, id := range global.DefaultSets {
+		sets = append(sets, global.Sets[fmt.Sprint(id)])
+	}
+	return p.emotes(sets), nil
+}
+
+func (p frankerFaceZ) Channel(ctx context.Context, channelID string) (Emotes, error) {
+	var room struct {
+		Sets map[string]frankerFaceZSet `json:"sets"`
+	}
+	if err := getJSON(ctx, "https://api.frankerfacez.com/v1/room/id/"+channelID, &room); err != nil {
+		return nil, err
+	}
+	sets := make([]frankerFaceZSet, 0, len(room.Sets))
+	for _, set := range room.Sets {
+		sets = append(sets, set)
+	}
+	return p.emotes(sets), nil
+}
+
+func (p frankerFaceZ) emotes(sets []frankerFaceZSet) Emotes {
+	emotes := make(Emotes)
+	for _, set := range sets {
+		for _, emote := range set.Emoticons {
+			if url, ok := emote.Animated["1"]; ok {
+				emotes[emote.Name] = Emote{URL: https(url), Animated: true, Provider: p.Name()}
+			} else if url, ok := emote.URLs["1"]; ok {
+				emotes[emote.Name] = Emote{URL: https(url), Provider: p.Name()}
+			}
+		}
+	}
+	return emotes
+}
+
+// 7TV - https://7tv.io/docs
+
+type sevenTV struct{}
+
+type sevenTVSet struct {
+	Emotes []struct {
+		Name string `json:"name"`
+		Data struct {
+			Animated bool `json:"animated"`
+			Host     struct {
+				URL string `json:"url"`
+			} `json:"host"`
+		} `json:"data"`
+	} `json:"emotes"`
+}
+
+func (sevenTV) Name() string { return "7tv" }
+
+func (p sevenTV) Global(ctx context.Context) (Emotes, error) {
+	var global sevenTVSet
+	if err := getJSON(ctx, "https://7tv.io/v3/emote-sets/global", &global); err != nil {
+		return nil, err
+	}
+	return p.emotes(global), nil
+}
+
+func (p sevenTV) Channel(ctx context.Context, channelID string) (Emotes, error) {
+	var user struct {
+		EmoteSet sevenTVSet `json:"emote_set"`
+	}
+	if err := getJSON(ctx, "https://7tv.io/v3/users/twitch/"+channelID, &user); err != nil {
+		return nil, err
+	}
+	return p.emotes(user.EmoteSet), nil
+}
+
+func (p sevenTV) emotes(set sevenTVSet) Emotes {
+	emotes := make(Emotes, len(set.Emotes))
+	for _, emote := range set.Emotes {
+		emotes[emote.Name] = Emote{
+			URL:      https(emote.Data.Host.URL) + "/1x.webp",
+			Animated: emote.Data.Animated,
+			Provider: p.Name(),
+		}
+	}
+	return emotes
+}
+
+// Twitch - https://dev.twitch.tv/docs/api/reference#get-global-emotes
+
+var errNoHelixClient = errors.New("no helix client")
+
+type twitchEmotes struct {
+	client *helix.Client
+}
+
+func (twitchEmotes) Name() string { return "twitch" }
+
+func (p twitchEmotes) Global(ctx context.Context) (Emotes, error) {
+	if p.client == nil {
+		return nil, errNoHelixClient
+	}
+	span := helixSpan(ctx, "GetGlobalEmotes")
+	resp, err := p.client.GetGlobalEmotes()
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("GetGlobalEmotes: %s", resp.ErrorMessage)
+	}
+	return p.emotes(resp.Data.Emotes), nil
+}
+
+func (p twitchEmotes) Channel(ctx context.Context, channelID string) (Emotes, error) {
+	if p.client == nil {
+		return nil, errNoHelixClient
+	}
+	span := helixSpan(ctx, "GetChannelEmotes")
+	resp, err := p.client.GetChannelEmotes(&helix.GetChannelEmotesParams{BroadcasterID: channelID})
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("GetChannelEmotes: %s", resp.ErrorMessage)
+	}
+	return p.emotes(resp.Data.Emotes), nil
+}
+
+func (p twitchEmotes) emotes(list []helix.Emote) Emotes {
+	emotes := make(Emotes, len(list))
+	for _, emote := range list {
+		emotes[emote.Name] = twitchEmote(emote.ID)
+	}
+	return emotes
+}
+
+// twitchEmote uses the v2 CDN template, whose "default" format is the
+// animated image whenever the emote has one.
+func twitchEmote(id string) Emote {
+	return Emote{
+		URL:      "https://static-cdn.jtvnw.net/emoticons/v2/" + id + "/default/dark/1.0",
+		Provider: "twitch",
+	}
+}
+
+// emotesFromOffsets reads the emotes of a chat message from the "emotes"
+// IRC tag, e.g. "25:0-4,12-16/1902:6-10", whose offsets count code points
+// of text.
+func emotesFromOffsets(text, tag string) Emotes {
+	emotes := make(Emotes)
+	runes := []rune(text)
+	for _, emote := range strings.Split(tag, "/") {
+		split := strings.SplitN(emote, ":", 2)
+		if len(split) != 2 || !validEmoteID(split[0]) {
+			continue
+		}
+		for _, offsets := range strings.Split(split[1], ",") {
+			var start, end int
+			if _, err := fmt.Sscanf(offsets, "%d-%d", &start, &end); err != nil {
+				continue
+			}
+			if start < 0 || end < start || end >= len(runes) {
+				continue
+			}
+			emotes[string(runes[start:end+1])] = twitchEmote(split[0])
+		}
+	}
+	return emotes
+}
+
+func validEmoteID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEmotesFromOffsets(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		tag  string
+		want []string
+	}{
+		{"no emotes", "oi chat", "", nil},
+		{"one emote twice", "Kappa oi Kappa", "25:0-4,9-13", []string{"Kappa"}},
+		{"two emotes", "Kappa PogChamp", "25:0-4/88:6-13", []string{"Kappa", "PogChamp"}},
+		{"offsets count code points", "Olá 😀 Kappa", "25:6-10", []string{"Kappa"}},
+		{"emote after accents", "ação Kappa", "25:5-9", []string{"Kappa"}},
+		{"end past the text", "Kappa", "25:0-5", nil},
+		{"start past the text", "Kappa", "25:10-14", nil},
+		{"end before start", "Kappa", "25:4-0", nil},
+		{"negative start", "Kappa", "25:-1-4", nil},
+		{"missing end", "Kappa", "25:0-", nil},
+		{"not numbers", "Kappa", "25:a-b", nil},
+		{"huge offsets", "Kappa", "25:0-99999999999999999999", nil},
+		{"missing offsets", "Kappa", "25", nil},
+		{"empty offsets", "Kappa", "25:", nil},
+		{"invalid id", "Kappa", "25!:0-4", nil},
+		{"empty id", "Kappa", ":0-4", nil},
+		{"good and bad ranges", "Kappa", "25:9-12,0-4", []string{"Kappa"}},
+		{"empty text", "", "25:0-4", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := emotesFromOffsets(tt.text, tt.tag)
+			var names []string
+			for _, name := range tt.want {
+				if got[name].URL == "" {
+					t.Errorf("emotesFromOffsets() is missing %q: %v", name, got)
+				}
+				names = append(names, name)
+			}
+			if len(got) != len(names) {
+				t.Errorf("emotesFromOffsets() = %v, want only %v", got, names)
+			}
+		})
+	}
+
+	got := emotesFromOffsets("Kappa", "25:0-4")
+	if want := (Emotes{"Kappa": twitchEmote("25")}); !reflect.DeepEqual(got, want) {
+		t.Errorf("emotesFromOffsets() = %v, want %v", got, want)
+	}
+}
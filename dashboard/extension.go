@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt"
+)
+
+// Extension roles, as in the "role" claim of the extension JWT.
+const (
+	roleBroadcaster = "broadcaster"
+	roleModerator   = "moderator"
+	roleExternal    = "external"
+)
+
+const (
+	// broadcasterSegment is the configuration segment the config page of
+	// the extension edits.
+	broadcasterSegment = "broadcaster"
+	// configVersion is the version of what we keep in broadcasterSegment.
+	configVersion = "1"
+	// maxSegmentSize is how much Twitch keeps per segment.
+	maxSegmentSize = 5 * 1024
+)
+
+// extensionSecret signs the JWTs of the extension, both the ones Twitch
+// hands to the panel and the ones we use to call the Extensions API. main
+// loads it with loadExtensionSecret.
+var extensionSecret []byte
+
+// loadExtensionSecret decodes the base64 EXTENSION_SECRET.
+func loadExtensionSecret() ([]byte, error) {
+	secret, err := base64.StdEncoding.DecodeString(envString("EXTENSION_SECRET", "gYPYgF/qbvWe+tp9bmhsXapRyXQATBQcVg1YVelr3Ss="))
+	if err != nil {
+		return nil, fmt.Errorf("EXTENSION_SECRET: %w", err)
+	}
+	return secret, nil
+}
+
+var (
+	errNoToken           = errors.New("no bearer token")
+	errExtensionDisabled = errors.New("EXTENSION_CLIENT_ID and EXTENSION_OWNER_ID not set")
+)
+
+// extensionClaims validates the extension JWT sent in the Authorization
+// header of r and returns its claims.
+func extensionClaims(r *http.Request) (jwt.MapClaims, error) {
+	split := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(split) != 2 || split[0] != "Bearer" || split[1] == "" {
+		return nil, errNoToken
+	}
+	token, err := jwt.Parse(split[1], func(tkn *jwt.Token) (interface{}, error) {
+		if _, ok := tkn.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", tkn.Header["alg"])
+		}
+		return extensionSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// extensionConfig reads and writes the broadcaster segment of the
+// Extensions Configuration Service, where the config page of the panel
+// keeps the channel settings:
+// https://dev.twitch.tv/docs/extensions/reference#get-extension-configuration-segment
+type extensionConfig struct {
+	twitch   *twitchAPI
+	clientID string
+	ownerID  string
+}
+
+func newExtensionConfig(twitch *twitchAPI) *extensionConfig {
+	return &extensionConfig{
+		twitch:   twitch,
+		clientID: envString("EXTENSION_CLIENT_ID", ""),
+		ownerID:  envString("EXTENSION_OWNER_ID", ""),
+	}
+}
+
+// Enabled tells whether the extension is configured; without it settings
+// live only in Redis.
+func (e *extensionConfig) Enabled() bool {
+	return e.clientID != "" && e.ownerID != ""
+}
+
+type configSegment struct {
+	Segment       string `json:"segment"`
+	BroadcasterID string `json:"broadcaster_id,omitempty"`
+	Content       string `json:"content"`
+	Version       string `json:"version"`
+}
+
+// Get returns the settings kept in the broadcaster segment of channelID, or
+// nil when the segment is empty or holds something else.
+func (e *extensionConfig) Get(ctx context.Context, channelID string) (*channelSettings, error) {
+	if !e.Enabled() {
+		return nil, errExtensionDisabled
+	}
+	query := url.Values{
+		"extension_id":   {e.clientID},
+		"segment":        {broadcasterSegment},
+		"broadcaster_id": {channelID},
+	}
+	var resp struct {
+		Data []configSegment `json:"data"`
+	}
+	if err := e.do(ctx, http.MethodGet, "/extensions/configurations?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, segment := range resp.Data {
+		if segment.Segment != broadcasterSegment || segment.Content == "" {
+			continue
+		}
+		if segment.Version != configVersion {
+			slog.Warn("ignoring extension config version", logChannelID, channelID, "version", segment.Version)
+			return nil, nil
+		}
+		settings := defaultSettings()
+		if err := json.Unmarshal([]byte(segment.Content), settings); err != nil {
+			return nil, fmt.Errorf("broadcaster segment: %w", err)
+		}
+		if err := settings.validate(); err != nil {
+			return nil, fmt.Errorf("broadcaster segment: %w", err)
+		}
+		return settings, nil
+	}
+	return nil, nil
+}
+
+// Set replaces the broadcaster segment of channelID with settings.
+func (e *extensionConfig) Set(ctx context.Context, channelID string, settings *channelSettings) error {
+	if !e.Enabled() {
+		return errExtensionDisabled
+	}
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if len(content) > maxSegmentSize {
+		return fmt.Errorf("broadcaster segment: %d bytes, limit is %d", len(content), maxSegmentSize)
+	}
+	body, _ := json.Marshal(struct {
+		ExtensionID string `json:"extension_id"`
+		configSegment
+	}{
+		ExtensionID: e.clientID,
+		configSegment: configSegment{
+			Segment:       broadcasterSegment,
+			BroadcasterID: channelID,
+			Content:       string(content),
+			Version:       configVersion,
+		},
+	})
+	return e.do(ctx, http.MethodPut, "/extensions/configurations", body, nil)
+}
+
+// do calls the Extensions API authenticated as the extension itself, with
+// a short-lived JWT of the external role.
+func (e *extensionConfig) do(ctx context.Context, method, path string, body []byte, v interface{}) error {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":     time.Now().Add(time.Minute).Unix(),
+		"user_id": e.ownerID,
+		"role":    roleExternal,
+	}).SignedString(extensionSecret)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, e.twitch.apiURL(path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Client-Id", e.clientID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := e.twitch.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiError struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiError)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, apiError.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// extensionCORS lets the extension, served from Twitch's CDN, call us.
+func extensionCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-Request-Id")
+}
+
+// HandleExtensionConfig is the backend of the config page of the extension:
+// GET returns the settings of the channel and the choices available, POST
+// validates and saves new settings. Only the broadcaster gets in.
+func HandleExtensionConfig(hub *Hub, redisConn *redis.Client, extConfig *extensionConfig, audit *auditLog, w http.ResponseWriter, r *http.Request) {
+	extensionCORS(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	claims, err := extensionClaims(r)
+	if err != nil {
+		slog.Warn("invalid extension jwt", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	channelID, _ := claims["channel_id"].(string)
+	if role, _ := claims["role"].(string); role != roleBroadcaster || channelID == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		// canais configurados antes de existir o dashboard só têm o segmento
+		if n, err := redisConn.Exists(ctx, settingsKey(channelID)).Result(); err == nil && n == 0 && extConfig.Enabled() {
+			if settings, err := extConfig.Get(ctx, channelID); err != nil {
+				slog.Error("loading extension config", logChannelID, channelID, "error", err)
+			} else if settings != nil {
+				if err = saveSettings(ctx, redisConn, channelID, settings); err != nil {
+					slog.Error("saving settings", logChannelID, channelID, "error", err)
+				}
+			}
+		}
+	case http.MethodPost:
+		settings, err := loadSettings(ctx, redisConn, channelID)
+		if err != nil {
+			slog.Error("loading settings", logChannelID, channelID, "error", err)
+		}
+		// guardado antes do Decode, que reaproveita as listas de settings
+		old, _ := json.Marshal(settings)
+		if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSegmentSize)).Decode(settings); err != nil {
+			http.Error(w, "Configurações inválidas.", http.StatusBadRequest)
+			return
+		}
+		if err = settings.validate(); err != nil {
+			http.Error(w, "Configurações não salvas: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		if err = applySettings(ctx, hub, redisConn, extConfig, channelID, settings); err != nil {
+			slog.Error("applying settings", logChannelID, channelID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		broadcasterID, _ := claims["user_id"].(string)
+		if broadcasterID == "" {
+			broadcasterID = channelID
+		}
+		audit.Record(ctx, broadcasterID, channelID, auditSettings, "", json.RawMessage(old), settings)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := loadSettings(ctx, redisConn, channelID)
+	if err != nil {
+		slog.Error("loading settings", logChannelID, channelID, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Settings          *channelSettings `json:"settings"`
+		Voices            []string         `json:"voices"`
+		Themes            []string         `json:"themes"`
+		AnonymousPolicies []string         `json:"anonymous_policies"`
+	}{settings, availableVoices, themes, anonymousPolicies})
+}
@@ -7,48 +7,43 @@ import (
 	_ "embed"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 	"github.com/gorilla/websocket"
 	"github.com/nicklaw5/helix"
-	"github.com/parnurzeal/gorequest"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	oauthSessionName = "oauth-session"
 	oauthTokenKey    = "oauth-token"
+	userIDKey        = "user-id"
 )
 
-type betterTTV struct {
-	UrlTemplate string   `json:"urlTemplate"`
-	Bots        []string `json:"bots"`
-	Emotes      []struct {
-		Id        string `json:"id"`
-		Channel   string `json:"channel"`
-		Code      string `json:"code"`
-		ImageType string `json:"imageType"`
-	} `json:"emotes"`
-}
-
 var (
-	scopes = []string{"user:read:email"}
+	scopes = []string{"user:read:email", "moderation:read"}
 	/**
-	redirectURL = "http://localhost:7001/redirect"
+	baseURL = "http://localhost:7001"
 	/*/
-	redirectURL = "https://vox-twitch.monique.dev/redirect"
+	baseURL = "https://vox-twitch.monique.dev"
 	/**/
-	cookieSecret = []byte("my awesome cookie secret <3 monique.dev")
-	cookieStore  = sessions.NewCookieStore(cookieSecret)
+	redirectURL = baseURL + "/redirect"
+	// set by main, with newCookieStore
+	cookieStore *sessions.CookieStore
 
 	//go:embed .oauth_client_id
 	clientID string
@@ -63,6 +58,14 @@ var (
 	loggedInHTML string
 	//go:embed layer.html
 	layerHtml string
+	//go:embed history.html
+	historyHTML string
+	//go:embed audit.html
+	auditHTML string
+	//go:embed admin.html
+	adminHTML string
+	//go:embed unavailable.html
+	unavailableHTML string
 	//go:embed elm/elm.min.js
 	elmMinJs []byte
 )
@@ -77,8 +80,7 @@ var upgrader = websocket.Upgrader{
 
 // HandleRoot is a Handler that shows a login button. In production, if the frontend is served / generated
 // by Go, it should use html/template to prevent XSS attacks.
-func HandleRoot(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	log.Println("URL:", r.URL)
+func HandleRoot(hub *Hub, redisConn *redis.Client, twitch *twitchAPI, profiles *profileCache, moderators *moderatorList, channels *channelRegistry, quotas *quotaTracker, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -87,7 +89,7 @@ func HandleRoot(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// get cookie jar
 	session, err := cookieStore.Get(r, oauthSessionName)
 	if err != nil {
-		log.Printf("HandleRoot > corrupted session: %v -- generated new", err)
+		slog.Warn("corrupted session, generated a new one", "error", err)
 	}
 
 	// session still valid?
@@ -103,43 +105,43 @@ func HandleRoot(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	var ok bool
 	token, ok := oauthToken.(*helix.AccessCredentials)
 	if !ok {
-		log.Println("HandleRoot > oauthToken is not *helix.AccessCredentials")
+		slog.Error("session token is not *helix.AccessCredentials")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	// new twitch api client
-	client, err := helix.NewClient(&helix.Options{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-	})
+	client, err := twitch.OAuth()
 	if err != nil {
-		log.Println("HandleRoot > NewClient:", err)
+		slog.Error("creating twitch client", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	// access token still valid?
-	if ok, _, _ := client.ValidateToken(token.AccessToken); !ok {
+	span := helixSpan(r.Context(), "ValidateToken")
+	valid, _, err := client.ValidateToken(token.AccessToken)
+	endSpan(span, err)
+	if !valid {
 		// create new access token using the refresh token
 		var resp *helix.RefreshTokenResponse
 		if resp, err = client.RefreshUserAccessToken(token.RefreshToken); err != nil {
-			log.Println("HandleRoot > refreshToken:", err)
+			slog.Warn("refreshing user token", "error", err)
 			// clear cookies
 			session.Options.MaxAge = -1
 			if err = session.Save(r, w); err != nil {
-				log.Println("session.Save:", err)
+				slog.Error("saving session", "error", err)
 			}
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return
 		}
 		session, err := cookieStore.Get(r, oauthSessionName)
 		if err != nil {
-			log.Printf("HandleRoot > corrupted session: %v -- generated new", err)
+			slog.Warn("corrupted session, generated a new one", "error", err)
 		}
 		session.Values[oauthTokenKey] = resp.Data
-		if session.Save(r, w) != nil {
-			log.Println("HandleRoot > error saving session:", err)
+		if err = session.Save(r, w); err != nil {
+			slog.Error("saving session", "error", err)
 			return
 		}
 		token = &resp.Data
@@ -149,20 +151,22 @@ func HandleRoot(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	client.SetUserAccessToken(token.AccessToken)
 
 	// get current user profile
+	span = helixSpan(r.Context(), "GetUsers")
 	user, err := client.GetUsers(nil)
+	endSpan(span, err)
 	if err != nil {
-		log.Println("HandleRoot > client.GetUsers:", err)
+		slog.Error("fetching the logged-in user", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	// sanity check
 	if len(user.Data.Users) == 0 {
-		log.Println("HandleRoot > len(userData.Users):", len(user.Data.Users))
+		slog.Warn("token of no user, logging out")
 		// clear cookies
 		session.Options.MaxAge = -1
 		if err = session.Save(r, w); err != nil {
-			log.Println("session.Save:", err)
+			slog.Error("saving session", "error", err)
 		}
 		// return to home page
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -170,7 +174,90 @@ func HandleRoot(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// current user
-	log.Println("HandleRoot > channel:", user.Data.Users[0].ID)
+	userID := user.Data.Users[0].ID
+	slog.Debug("dashboard", logUserID, userID)
+	flashes := session.Flashes()
+	if session.Values[userIDKey] != userID || len(flashes) > 0 {
+		session.Values[userIDKey] = userID
+		if err = session.Save(r, w); err != nil {
+			slog.Error("saving session", logUserID, userID, "error", err)
+		}
+	}
+	channels.Register(r.Context(), userID)
+	current, err := moderators.User(r)
+	if err == errChannelUnavailable && current.ChannelID == userID {
+		renderUnavailable(channels, w, r, userID)
+		return
+	}
+	if err == errNotModerator || err == errChannelUnavailable {
+		slog.Warn("can't manage channel", logChannelID, current.ChannelID, logUserID, current.UserID, "error", err)
+		delete(session.Values, channelIDKey)
+		if err == errNotModerator {
+			session.AddFlash("Você não é mais moderador desse canal.")
+		} else {
+			session.AddFlash("Esse canal não está disponível no momento.")
+		}
+		if err = session.Save(r, w); err != nil {
+			slog.Error("saving session", logUserID, userID, "error", err)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		slog.Error("loading dashboard user", logUserID, userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	channelID := current.ChannelID
+	moderated, err := moderators.Channels(r.Context(), userID)
+	if err != nil {
+		slog.Error("listing moderated channels", logUserID, userID, "error", err)
+	}
+	var switchable []profile
+	if len(moderated) > 0 {
+		lookup := profiles.Lookup(r.Context(), append([]string{userID}, moderated...))
+		switchable = append(switchable, lookup[userID])
+		for _, id := range moderated {
+			switchable = append(switchable, lookup[id])
+		}
+	}
+	var channelModerators []*moderator
+	if current.Can(permModerators) {
+		if channelModerators, err = moderators.List(r.Context(), channelID); err != nil {
+			slog.Error("listing moderators", logChannelID, channelID, logUserID, userID, "error", err)
+		}
+	}
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		slog.Error("creating csrf token", logUserID, userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	settings, err := loadSettings(r.Context(), redisConn, channelID)
+	if err != nil {
+		slog.Error("loading settings", logChannelID, channelID, logUserID, userID, "error", err)
+	}
+	pending, err := listPending(r.Context(), redisConn, channelID)
+	if err != nil {
+		slog.Error("listing pending messages", logChannelID, channelID, logUserID, userID, "error", err)
+	}
+	_, overlayConnected := hub.Overlay(channelID)
+	blocks, err := listBlocks(r.Context(), redisConn, channelID)
+	if err != nil {
+		slog.Error("listing blocks", logChannelID, channelID, logUserID, userID, "error", err)
+	}
+	blockedAttempts, err := listBlockedAttempts(r.Context(), redisConn, channelID, 10)
+	if err != nil {
+		slog.Error("listing blocked attempts", logChannelID, channelID, logUserID, userID, "error", err)
+	}
+	layerThemes, err := listLayerThemes(r.Context(), redisConn, channelID)
+	if err != nil {
+		slog.Error("listing layer themes", logChannelID, channelID, logUserID, userID, "error", err)
+	}
+	quota, err := quotas.Status(r.Context(), channelID)
+	if err != nil {
+		slog.Error("loading quota status", logChannelID, channelID, logUserID, userID, "error", err)
+	}
 	////const botID = "661856691"
 	////const profID = "551257512"
 	////const punkID = "533882077"
@@ -182,34 +269,98 @@ func HandleRoot(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// load login page template
 	tmpl, err := template.New("index").Parse(loggedInHTML)
 	if err != nil {
-		log.Println("HandleRoot > error creating template:", err)
+		slog.Error("creating dashboard template", "error", err)
 		return
 	}
 
 	// update login page template
 	parsed := bytes.NewBufferString("")
 	err = tmpl.Execute(parsed, struct {
-		UserID string
-		Online []TwitchUser
-	}{UserID: user.Data.Users[0].ID, Online: hub.Online(client)})
+		User              dashboardUser
+		Channels          []profile
+		Moderators        []*moderator
+		CSRFToken         string
+		Flashes           []interface{}
+		Settings          *channelSettings
+		Voices            []string
+		Themes            []string
+		AnonymousPolicies []string
+		Pending           []pendingMessage
+		Blocks            []*block
+		BlockedAttempts   []blockedAttempt
+		BlockDurations    []blockDuration
+		LayerThemes       []namedLayerTheme
+		LayerTheme        layerTheme
+		LayerPositions    []string
+		Quota             quotaStatus
+		Online            []TwitchUser
+		OverlayConnected  bool
+	}{
+		User:              current,
+		Channels:          switchable,
+		Moderators:        channelModerators,
+		CSRFToken:         csrf,
+		Flashes:           flashes,
+		Settings:          settings,
+		Voices:            availableVoices,
+		Themes:            themes,
+		AnonymousPolicies: anonymousPolicies,
+		Pending:           pending,
+		Blocks:            blocks,
+		BlockedAttempts:   blockedAttempts,
+		BlockDurations:    blockDurations,
+		LayerThemes:       layerThemes,
+		LayerTheme:        defaultLayerTheme(),
+		LayerPositions:    layerPositions,
+		Quota:             quota,
+		Online:            hub.Online(r.Context(), profiles),
+		OverlayConnected:  overlayConnected,
+	})
 	if err != nil {
-		log.Println("HandleRoot > error parsing html:", err)
+		slog.Error("rendering dashboard template", logChannelID, channelID, logUserID, userID, "error", err)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	_, err = w.Write(parsed.Bytes())
 }
 
+// HandleRefreshEmotes fetches the emotes of the logged-in channel again,
+// so newly added emotes show up without waiting for the cache to expire.
+func HandleRefreshEmotes(emoteCache *emoteCache, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permSettings)
+	if !ok {
+		return
+	}
+	emotes := emoteCache.Refresh(user.ChannelID)
+	audit.Record(r.Context(), user.UserID, user.ChannelID, auditEmotesRefresh, "", nil, len(emotes))
+	slog.Info("emotes refreshed", logChannelID, user.ChannelID, logUserID, user.UserID, "count", len(emotes))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// newCookieStore signs the session cookies with SESSION_HASH_KEY and
+// encrypts them with SESSION_BLOCK_KEY, both base64 encoded: at least 32
+// bytes for the former, and 16, 24 or 32 for the latter, e.g. the output of
+// "openssl rand -base64 32". Whoever knows them can forge sessions, so there
+// are no defaults.
+func newCookieStore() (*sessions.CookieStore, error) {
+	hashKey, err := base64.StdEncoding.DecodeString(os.Getenv("SESSION_HASH_KEY"))
+	if err != nil || len(hashKey) < 32 {
+		return nil, errors.New("SESSION_HASH_KEY must be at least 32 bytes, base64 encoded")
+	}
+	blockKey, err := base64.StdEncoding.DecodeString(os.Getenv("SESSION_BLOCK_KEY"))
+	if err != nil || (len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32) {
+		return nil, errors.New("SESSION_BLOCK_KEY must be 16, 24 or 32 bytes, base64 encoded")
+	}
+	return sessions.NewCookieStore(hashKey, blockKey), nil
+}
+
 // HandleLogin is a Handler that redirects the user to Twitch for login, and provides the 'state'
 // parameter which protects against login CSRF.
-func HandleLogin(w http.ResponseWriter, r *http.Request) {
+func HandleLogin(twitch *twitchAPI, w http.ResponseWriter, r *http.Request) {
 	// new twitch api client
-	client, err := helix.NewClient(&helix.Options{
-		ClientID:    clientID,
-		RedirectURI: redirectURL,
-	})
+	client, err := twitch.OAuth()
 	if err != nil {
-		log.Println("HandleLogin > NewClient:", err)
+		slog.Error("creating twitch client", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -217,7 +368,7 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	// create state token
 	var tokenBytes [255]byte
 	if _, err := rand.Read(tokenBytes[:]); err != nil {
-		log.Println("HandleLogin > Couldn't generate a token:", err)
+		slog.Error("generating oauth state", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -239,7 +390,7 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 	// get cookie jar
 	session, err := cookieStore.Get(r, oauthSessionName)
 	if err != nil {
-		log.Println("HandleLogout > cookieStore.Get:", err)
+		slog.Warn("loading session", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -247,7 +398,7 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 	// clear cookies
 	session.Options.MaxAge = -1
 	if err = session.Save(r, w); err != nil {
-		log.Println("HandleLogout > session.Save:", err)
+		slog.Error("saving session", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -256,15 +407,11 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 
 // HandleOAuth2Callback is a Handler for oauth's 'redirect_uri' endpoint;
 // it validates the state token and retrieves an OAuth token from the request parameters.
-func HandleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
+func HandleOAuth2Callback(twitch *twitchAPI, w http.ResponseWriter, r *http.Request) {
 	// new twitch api client
-	client, err := helix.NewClient(&helix.Options{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURI:  redirectURL,
-	})
+	client, err := twitch.OAuth()
 	if err != nil {
-		log.Println("HandleOAuth2Callback > NewClient:", err)
+		slog.Error("creating twitch client", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -273,9 +420,11 @@ func HandleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 
 	code := r.FormValue("code")
 
+	span := helixSpan(r.Context(), "RequestUserAccessToken")
 	token, err := client.RequestUserAccessToken(code)
+	endSpan(span, err)
 	if err != nil {
-		log.Println("HandleOAuth2Callback > RequestUserAccessToken:", err)
+		slog.Warn("requesting user token", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -283,7 +432,7 @@ func HandleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	// get cookie jar
 	session, err := cookieStore.Get(r, oauthSessionName)
 	if err != nil {
-		log.Printf("HandleOAuth2Callback > corrupted session: %v -- generated new", err)
+		slog.Warn("corrupted session, generated a new one", "error", err)
 	}
 
 	// store cookie with access token data
@@ -297,30 +446,55 @@ func HandleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleLayer responds a personalized layer for the current user.
-func HandleLayer(w http.ResponseWriter, r *http.Request) {
-	log.Println("HandleLayer > URL:", r.URL)
+func HandleLayer(redisConn *redis.Client, w http.ResponseWriter, r *http.Request) {
 	split := strings.Split(r.URL.Path, "/")
 	if len(split) != 4 {
-		log.Println("HandleLayer > len(split):", len(split))
+		slog.Warn("invalid layer url", "path", r.URL.Path)
 		return
 	}
 	userID := split[2]
-	log.Println("HandleLayer > userID:", userID)
+	slog.Debug("layer requested", logChannelID, userID)
+
+	// tema salvo no dashboard + parâmetros da url
+	var err error
+	query := r.URL.Query()
+	theme := defaultLayerTheme()
+	if name := query.Get("theme"); name != "" {
+		if theme, err = loadLayerTheme(r.Context(), redisConn, userID, name); err != nil {
+			slog.Warn("loading layer theme", logChannelID, userID, "theme", name, "error", err)
+			theme = defaultLayerTheme()
+		}
+	}
+	if err = theme.apply(query); err != nil {
+		slog.Warn("invalid layer parameter", logChannelID, userID, "error", err)
+	}
+	layerWidth, _ := strconv.Atoi(query.Get("layer-width"))
+	layerHeight, _ := strconv.Atoi(query.Get("layer-height"))
 
 	// load layer page template
 	tmpl, err := template.New("layer").Parse(layerHtml)
 	if err != nil {
-		log.Println("HandleLayer > error creating template:", err)
+		slog.Error("creating layer template", "error", err)
 		return
 	}
 
 	// update layer page template
 	parsed := bytes.NewBufferString("")
 	err = tmpl.Execute(parsed, struct {
-		UserID string
-	}{UserID: userID})
+		UserID      string
+		Preview     bool
+		Theme       layerTheme
+		LayerWidth  int
+		LayerHeight int
+	}{
+		UserID:      userID,
+		Preview:     query.Get("preview") == "true",
+		Theme:       theme,
+		LayerWidth:  layerWidth,
+		LayerHeight: layerHeight,
+	})
 	if err != nil {
-		log.Println("HandleLayer > error parsing html:", err)
+		slog.Error("rendering layer template", logChannelID, userID, "error", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -330,11 +504,10 @@ func HandleLayer(w http.ResponseWriter, r *http.Request) {
 
 // HandleWebsocket
 // arquitetura chupinhada daqui: https://github.com/gorilla/websocket/tree/master/examples/chat
-func HandleWebsocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	log.Println("HandleWebsocket > URL:", r.URL)
+func HandleWebsocket(hub *Hub, redisConn *redis.Client, emoteCache *emoteCache, channels *channelRegistry, w http.ResponseWriter, r *http.Request) {
 	split := strings.Split(r.URL.Path, "/")
 	if len(split) != 3 {
-		log.Println("HandleWebsocket > len(split):", len(split))
+		slog.Warn("invalid websocket url", "path", r.URL.Path)
 		return
 	}
 	userID := split[2]
@@ -342,31 +515,55 @@ func HandleWebsocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// Upgrade HTTP connection
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("HandleWebsocket: Upgrade error:", err)
+		slog.Warn("upgrading websocket", logChannelID, userID, "error", err)
 		return
 	}
 
-	// create current user state
-	client := &Client{
-		id:   userID,
-		hub:  hub,
-		conn: conn,
-		send: make(chan *Message, 256),
+	settings, err := loadSettings(r.Context(), redisConn, userID)
+	if err != nil {
+		slog.Error("loading settings", logChannelID, userID, "error", err)
 	}
 
-	// Connect to voxfala RabbitMQ
-	if client.amqpConn, err = amqp.Dial(os.Getenv("RABBITMQ_URL")); err != nil {
-		log.Println("MQ connection:", err)
-	}
-	if client.amqpChan, err = client.amqpConn.Channel(); err != nil {
-		log.Println("MQ channel:", err)
+	// o preview do dashboard não conta como overlay online
+	role := roleOverlay
+	if r.URL.Query().Get("role") == rolePreview {
+		role = rolePreview
 	}
-	if err = client.amqpChan.Qos(1, 0, false); err != nil {
-		log.Println("MQ channel QoS:", err)
+
+	// create current user state
+	client := &Client{
+		id:          userID,
+		role:        role,
+		hub:         hub,
+		conn:        conn,
+		send:        make(chan *Envelope, 256),
+		greeted:     make(chan struct{}),
+		settings:    settings.Overlay(),
+		connectedAt: time.Now(),
+	}
+
+	// Connect to voxfala RabbitMQ; o preview nunca sintetiza
+	if role == roleOverlay {
+		if client.amqpConn, err = amqp.Dial(os.Getenv("RABBITMQ_URL")); err != nil {
+			slog.Error("connecting to rabbitmq", logChannelID, userID, "error", err)
+		}
+		if client.amqpChan, err = client.amqpConn.Channel(); err != nil {
+			slog.Error("opening rabbitmq channel", logChannelID, userID, "error", err)
+		}
+		if err = client.amqpChan.Qos(1, 0, false); err != nil {
+			slog.Error("setting rabbitmq qos", logChannelID, userID, "error", err)
+		}
 	}
 
 	// register current user state
 	client.hub.register <- client
+	slog.Info("websocket connected", logChannelID, userID, "role", role)
+	// o id vem da URL, sem autenticação: só canais conhecidos
+	if registered, err := channels.Registered(r.Context(), userID); err != nil {
+		slog.Error("checking channel registration", logChannelID, userID, "error", err)
+	} else if registered {
+		emoteCache.Warm(userID)
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -374,158 +571,319 @@ func HandleWebsocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	go client.readPump()
 }
 
-func HandleTTS(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+func HandleTTS(hub *Hub, redisConn *redis.Client, history *messageHistory, profiles *profileCache, emoteCache *emoteCache, channels *channelRegistry, quotas *quotaTracker, w http.ResponseWriter, r *http.Request) {
+	extensionCORS(w)
 
 	if r.Method == "OPTIONS" {
 		return
 	}
 
-	log.Println("HandleTTS > URL:", r.URL)
+	// segue a mensagem até o worker, o hub e o overlay
+	requestID := uuid.New().String()
+	w.Header().Set("X-Request-Id", requestID)
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String(logRequestID, requestID))
+	logger := slog.With(logRequestID, requestID)
+	if span.SpanContext().IsValid() {
+		logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+	}
+	logger.Debug("tts request", "url", r.URL.String())
 
 	var split []string
 	if split = strings.Split(r.URL.Path, "/"); len(split) != 3 {
-		log.Println("HandleTTS > len(url split):", len(split))
+		logger.Warn("invalid tts url", "path", r.URL.Path)
+		ttsRequests.WithLabelValues("bad_request").Inc()
 		return
 	}
-	var authHeader string
-	if authHeader = r.Header.Get("Authorization"); authHeader == "" {
-		log.Println("HandleTTS > Authorization header not found")
-		return
-	}
-	if split = strings.Split(authHeader, " "); len(split) != 2 {
-		log.Println("HandleTTS > len(auth split):", len(split))
+	claims, err := extensionClaims(r)
+	if err != nil {
+		logger.Warn("invalid extension jwt", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		ttsRequests.WithLabelValues("unauthorized").Inc()
 		return
 	}
-	// [0]="Bearer" [1]=token
-	tokenString := split[1]
-	if tokenString == "" {
-		log.Println("HandleTTS > empty TokenString:", authHeader)
-		w.WriteHeader(http.StatusInternalServerError)
+
+	// user_id só vem quando o viewer compartilhou a identidade
+	channelID, _ := claims["channel_id"].(string)
+	userID, _ := claims["user_id"].(string)
+	opaqueUserID, _ := claims["opaque_user_id"].(string)
+	if channelID == "" || (userID == "" && opaqueUserID == "") {
+		logger.Warn("extension jwt without channel_id or user ids")
+		w.WriteHeader(http.StatusBadRequest)
+		ttsRequests.WithLabelValues("bad_request").Inc()
 		return
 	}
 
-	var token, err = jwt.Parse(tokenString, func(tkn *jwt.Token) (interface{}, error) {
-		if _, ok := tkn.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", tkn.Header["alg"])
-		}
-		return base64.StdEncoding.DecodeString("gYPYgF/qbvWe+tp9bmhsXapRyXQATBQcVg1YVelr3Ss=")
-	})
+	viewerID := userID
+	if viewerID == "" {
+		viewerID = opaqueUserID
+	}
+	logger = logger.With(logChannelID, channelID, logUserID, viewerID)
+	span.SetAttributes(attribute.String(logChannelID, channelID), attribute.String(logUserID, viewerID))
 
-	if err != nil || !token.Valid {
-		log.Println("HandleTTS > error parsing jwt:", err)
+	// suspenso ou fora do beta fechado
+	if available, err := channels.Available(r.Context(), channelID); err != nil {
+		logger.Error("checking channel availability", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		ttsRequests.WithLabelValues("error").Inc()
+		return
+	} else if !available {
+		logger.Info("tts refused: channel unavailable")
+		http.Error(w, "O TTS não está disponível neste canal.", http.StatusForbidden)
+		ttsRequests.WithLabelValues("unavailable").Inc()
 		return
-	}
-
-	channelID := ""
-	userID := ""
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		channelID = claims["channel_id"].(string)
-		userID = claims["user_id"].(string)
 	}
 
 	// is channel registered (online)?
-	if _, found := hub.clients[channelID]; !found {
-		log.Println("HandleTTS > hub.clients not found:", channelID)
+	c, found := hub.Overlay(channelID)
+	if !found {
+		logger.Info("tts refused: no overlay connected")
 		w.WriteHeader(http.StatusNotFound)
 		_, _ = w.Write([]byte(fmt.Sprintf("channel %q is offline", channelID)))
+		ttsRequests.WithLabelValues("offline").Inc()
 		return
 	}
 
-	// new twitch api client
-	var client *helix.Client
-	if client, err = helix.NewClient(&helix.Options{ClientID: clientID, ClientSecret: clientSecret}); err != nil {
-		log.Println("HandleTTS > NewClient:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	ctx := r.Context()
+	// o JWT da extensão garante que o canal existe
+	channels.Register(ctx, channelID)
+	settings, err := loadSettings(ctx, redisConn, channelID)
+	if err != nil {
+		logger.Error("loading settings", "error", err)
 	}
 
-	// get app access token
-	var accessToken *helix.AppAccessTokenResponse
-	if accessToken, err = client.RequestAppAccessToken(nil); err != nil {
-		log.Println("HandleTTS > RequestAppAccessToken:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	text := strings.TrimSpace(r.FormValue("text"))
+	switch {
+	case !settings.Enabled:
+		http.Error(w, "O TTS está desativado neste canal.", http.StatusForbidden)
+		ttsRequests.WithLabelValues("disabled").Inc()
+		return
+	case text == "":
+		http.Error(w, "Digite uma mensagem.", http.StatusBadRequest)
+		ttsRequests.WithLabelValues("empty").Inc()
+		return
+	case utf8.RuneCountInString(text) > settings.MaxLength:
+		http.Error(w, fmt.Sprintf("A mensagem pode ter no máximo %d caracteres.", settings.MaxLength), http.StatusBadRequest)
+		ttsRequests.WithLabelValues("too_long").Inc()
+		return
+	}
+	if word, found := settings.Filtered(text); found {
+		logger.Info("tts refused: filtered word", "word", word)
+		http.Error(w, "Sua mensagem contém uma palavra bloqueada neste canal.", http.StatusBadRequest)
+		ttsRequests.WithLabelValues("filtered").Inc()
 		return
 	}
 
-	// update client's access token
-	client.SetAppAccessToken(accessToken.Data.AccessToken)
-
-	var userName, userPicture string
-	users, err := client.GetUsers(&helix.UsersParams{IDs: []string{userID}})
-	if err == nil && len(users.Data.Users) > 0 {
-		userName = users.Data.Users[0].DisplayName
-		userPicture = users.Data.Users[0].ProfileImageURL
+	// bloqueados não chegam nem a gastar o cooldown
+	if b, err := findBlock(ctx, redisConn, channelID, userID, opaqueUserID); err != nil {
+		logger.Error("looking up blocklist", "error", err)
+	} else if b != nil {
+		logger.Info("tts refused: viewer blocked")
+		logBlockedAttempt(ctx, redisConn, channelID, b.ViewerID, text)
+		http.Error(w, "Você não pode usar o TTS neste canal.", http.StatusForbidden)
+		ttsRequests.WithLabelValues("blocked").Inc()
+		return
 	}
 
-	var (
-		c  *Client
-		ok bool
-	)
-	if c, ok = hub.clients[channelID]; !ok {
-		log.Printf("HandleTTS > channel %q is offline: %v", channelID, err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// viewers anônimos são identificados pelo opaque id
+	if userID == "" {
+		if settings.AnonymousPolicy == anonymousReject {
+			logger.Info("tts refused: anonymous viewer")
+			http.Error(w, "Compartilhe sua identidade com a extensão para usar o TTS neste canal.", http.StatusForbidden)
+			ttsRequests.WithLabelValues("anonymous").Inc()
+			return
+		}
+	}
+	// cota estourada não gasta o cooldown do viewer
+	if exceeded, err := quotas.Check(ctx, channelID, utf8.RuneCountInString(text)); err != nil {
+		logger.Error("checking quotas", "error", err)
+	} else if exceeded != nil {
+		logger.Info("tts refused: quota exceeded", "period", exceeded.Period, "resource", exceeded.Resource)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(exceeded.ResetAt).Seconds())+1))
+		http.Error(w, exceeded.Message(), http.StatusTooManyRequests)
+		ttsRequests.WithLabelValues("quota").Inc()
+		return
+	}
+	if ok, wait, err := allowViewer(ctx, redisConn, channelID, viewerID, settings.Cooldown()); err != nil {
+		logger.Error("checking cooldown", "error", err)
+	} else if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, fmt.Sprintf("Aguarde %d segundos para mandar outra mensagem.", int(wait.Seconds())+1), http.StatusTooManyRequests)
+		ttsRequests.WithLabelValues("cooldown").Inc()
 		return
 	}
 
+	var sender profile
+	switch {
+	case userID != "":
+		sender = profiles.Get(ctx, userID)
+	case settings.AnonymousPolicy == anonymousNickname:
+		sender = nicknameProfile(opaqueUserID)
+	default:
+		sender = anonymousProfile(opaqueUserID)
+	}
+
 	// generates audio
-	text := r.FormValue("text")
-	var audioURL string
+	voice := settings.Voice(r.FormValue("voice"))
+	var audioID string
+	synthesisStart := time.Now()
+	synthesisCtx, synthesisSpan := tracer.Start(ctx, "tts.synthesize", trace.WithAttributes(
+		attribute.Int("tts.characters", utf8.RuneCountInString(text)),
+	))
 	const RETRIES = 5
 	for i := 0; i < RETRIES; i++ {
-		audioURL, err = c.TTS(text)
+		synthesisSpan.SetAttributes(attribute.Int("tts.attempts", i+1))
+		audioID, err = c.TTS(synthesisCtx, requestID, text, voice)
 		if err == nil || !strings.Contains(err.Error(), "busy") {
 			break
 		}
 		time.Sleep(time.Second)
 	}
+	ttsSynthesisDuration.Observe(time.Since(synthesisStart).Seconds())
+	endSpan(synthesisSpan, err)
 	if err != nil {
-		log.Println("HandleTTS > error generating audio:", err)
+		logger.Error("generating audio", "error", err)
+		failed := &Message{ID: uuid.New().String(), RequestID: requestID, ClientID: channelID, Text: text, UserName: sender.DisplayName, UserPicture: sender.Picture}
+		if err = history.Add(ctx, newHistoryEntry(failed, viewerID, voice, outcomeFailed), settings.HistoryRetention()); err != nil {
+			logger.Error("adding to history", "error", err)
+		}
+		// a mensagem não saiu: o viewer pode tentar de novo
+		if err = releaseViewer(ctx, redisConn, channelID, viewerID); err != nil {
+			logger.Error("releasing cooldown", "error", err)
+		}
 		w.WriteHeader(http.StatusInternalServerError)
+		ttsRequests.WithLabelValues("synthesis_failed").Inc()
 		return
 	}
+	if meta, err := saveAudioMeta(ctx, redisConn, audioID, channelID); err != nil {
+		logger.Error("saving audio metadata", "error", err)
+	} else {
+		audioSize.WithLabelValues("original").Observe(float64(meta.Size))
+	}
+	quotas.Add(ctx, channelID, utf8.RuneCountInString(text))
 
-	var emotes map[string]string
-	if channel, err := client.GetChannelInformation(&helix.GetChannelInformationParams{BroadcasterID: channelID}); err == nil && len(channel.Data.Channels) == 1 {
-		var betterTTV betterTTV
-		_, _, errs := gorequest.New().
-			Get("https://api.betterttv.net/2/channels/" + channel.Data.Channels[0].BroadcasterName).
-			EndStruct(&betterTTV)
-		if errs == nil {
-			emotes = make(map[string]string, len(betterTTV.Emotes))
-			for _, emote := range betterTTV.Emotes {
-				emotes[emote.Code] = emote.Id
-			}
-		}
+	emotes := emoteCache.Get(channelID)
+	// emotes do chat, quando o texto veio de lá
+	if offsets := r.FormValue("emote_offsets"); offsets != "" {
+		emotes.merge(emotesFromOffsets(text, offsets))
 	}
 
-	// send audio url to channel's websocket
-	hub.broadcast <- &Message{
+	message := &Message{
+		ID:          uuid.New().String(),
+		RequestID:   requestID,
+		AudioID:     audioID,
 		ClientID:    channelID,
-		AudioURL:    audioURL,
 		Text:        text,
 		Emotes:      emotes,
-		UserName:    userName,
-		UserPicture: userPicture,
+		UserName:    sender.DisplayName,
+		UserPicture: sender.Picture,
+	}
+
+	outcome := outcomeDelivered
+	if settings.ApprovalMode {
+		outcome = outcomePending
+	}
+	if err = history.Add(ctx, newHistoryEntry(message, viewerID, voice, outcome), settings.HistoryRetention()); err != nil {
+		logger.Error("adding to history", "error", err)
+	}
+
+	// streamer aprova antes de ir para o overlay
+	if settings.ApprovalMode {
+		if err = addPending(ctx, redisConn, message); err != nil {
+			logger.Error("adding to approval queue", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			ttsRequests.WithLabelValues("error").Inc()
+			return
+		}
+		logger.Info("tts pending approval", logMessageID, message.ID)
+		ttsRequests.WithLabelValues("pending").Inc()
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("Sua mensagem está aguardando a aprovação do streamer."))
+		return
+	}
+
+	deliver(ctx, hub, redisConn, message)
+	logger.Info("tts delivered", logMessageID, message.ID, "characters", utf8.RuneCountInString(text))
+	ttsRequests.WithLabelValues("delivered").Inc()
+}
+
+// deliver signs the audio URL of message and sends it to the overlay of its
+// channel, along with the audio itself when the overlay plays it inline.
+func deliver(ctx context.Context, hub *Hub, redisConn *redis.Client, message *Message) {
+	ctx, span := tracer.Start(ctx, "hub.deliver", trace.WithAttributes(
+		attribute.String(logChannelID, message.ClientID),
+		attribute.String(logMessageID, message.ID),
+	))
+	defer span.End()
+	message.spanContext = span.SpanContext()
+	message.AudioURL = playbackURL(message.AudioID, message.ClientID)
+	message.AudioData, message.AudioType, message.inlineAudio = nil, "", nil
+
+	// send the audio itself to overlays that can play it inline, loaded
+	// once for each format they asked for
+	tried := make(map[string]bool)
+	for _, c := range hub.Clients(message.ClientID) {
+		format := c.AudioFormat()
+		if !c.Supports(capInlineAudio) || tried[format.Name] {
+			continue
+		}
+		tried[format.Name] = true
+		audio, meta, err := loadAudio(ctx, redisConn, message.AudioID, message.ClientID, format)
+		if err != nil {
+			slog.Error("loading inline audio", logRequestID, message.RequestID, logChannelID, message.ClientID, logMessageID, message.ID, "format", format.Name, "error", err)
+			continue
+		}
+		if message.inlineAudio == nil {
+			message.inlineAudio = make(map[string]inlineAudio)
+		}
+		message.inlineAudio[format.Name] = inlineAudio{data: audio, contentType: meta.ContentType}
 	}
+
+	// send audio url to channel's websocket
+	hub.broadcast <- message
 }
 
+// HandleTTSPlay serves the audio of a signed /ttsPlay/ URL.
 func HandleTTSPlay(redisConn *redis.Client, w http.ResponseWriter, r *http.Request) {
 	audioID := strings.TrimPrefix(r.URL.Path, "/ttsPlay/")
-	b := redisConn.Get(context.Background(), audioID)
-	if b.Err() != nil {
-		log.Printf("HandleTTSPlay > audio %q not found: %v", audioID, b.Err())
-		http.NotFound(w, r)
+	channelID, expires, err := verifyPlayback(audioID, r.URL.Query())
+	if err == errPlaybackExpired {
+		http.Error(w, err.Error(), http.StatusGone)
 		return
 	}
-	bb, err := b.Bytes()
 	if err != nil {
-		log.Println("HandleTTSPlay > error getting audio bytes:", err)
+		slog.Warn("invalid playback url", "audio_id", audioID, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	format, ok := negotiateAudioFormat(r)
+	if !ok {
+		http.Error(w, "unsupported audio format", http.StatusNotAcceptable)
+		return
+	}
+	bb, meta, err := loadAudio(r.Context(), redisConn, audioID, channelID, format)
+	switch err {
+	case nil:
+	case redis.Nil:
+		slog.Info("audio not found", logChannelID, channelID, "audio_id", audioID)
+		http.NotFound(w, r)
+		return
+	case errAudioChannel:
+		slog.Warn("audio of another channel", logChannelID, channelID, "audio_id", audioID)
+		http.Error(w, errPlaybackSignature.Error(), http.StatusForbidden)
+		return
+	default:
+		slog.Error("loading audio", logChannelID, channelID, "audio_id", audioID, "error", err)
 		http.Error(w, "error getting bytes", http.StatusInternalServerError)
 		return
 	}
-	http.ServeContent(w, r, "audio.wav", time.Time{}, bytes.NewReader(bb))
+
+	maxAge := int(time.Until(expires).Seconds())
+	w.Header().Set("Content-Type", meta.ContentType)
+	w.Header().Set("Content-Disposition", `inline; filename="`+audioFileName(meta.ContentType)+`"`)
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d, immutable", maxAge))
+	w.Header().Set("Vary", "Accept")
+	http.ServeContent(w, r, audioFileName(meta.ContentType), meta.CreatedAt, bytes.NewReader(bb))
 }
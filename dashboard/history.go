@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Outcomes of a message in the history.
+const (
+	outcomeFailed    = "failed"
+	outcomePending   = "pending"
+	outcomeRejected  = "rejected"
+	outcomeDelivered = "delivered"
+	outcomePlayed    = "played"
+)
+
+var (
+	// historyMaxEntries caps the history of each channel, whatever its
+	// retention.
+	historyMaxEntries = envInt("HISTORY_MAX_ENTRIES", 1000)
+
+	historyOutcomes = []string{outcomeDelivered, outcomePlayed, outcomePending, outcomeRejected, outcomeFailed}
+	outcomeNames    = map[string]string{
+		outcomeDelivered: "enviada",
+		outcomePlayed:    "tocada",
+		outcomePending:   "aguardando aprovação",
+		outcomeRejected:  "rejeitada",
+		outcomeFailed:    "falhou",
+	}
+)
+
+// historyPageSize is how many entries the history page shows.
+const historyPageSize = 50
+
+// historyEntry is a message as recorded in the history of its channel.
+type historyEntry struct {
+	ID            string     `json:"id"`
+	RequestID     string     `json:"request_id,omitempty"`
+	ChannelID     string     `json:"channel_id"`
+	SenderID      string     `json:"sender_id"`
+	SenderName    string     `json:"sender_name"`
+	SenderPicture string     `json:"sender_picture"`
+	Text          string     `json:"text"`
+	Voice         string     `json:"voice"`
+	AudioID       string     `json:"audio_id"`
+	Outcome       string     `json:"outcome"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	PlayedAt      *time.Time `json:"played_at,omitempty"`
+}
+
+// newHistoryEntry records message, spoken with voice on behalf of
+// senderID.
+func newHistoryEntry(message *Message, senderID, voice, outcome string) *historyEntry {
+	now := time.Now()
+	entry := &historyEntry{
+		ID:            message.ID,
+		RequestID:     message.RequestID,
+		ChannelID:     message.ClientID,
+		SenderID:      senderID,
+		SenderName:    message.UserName,
+		SenderPicture: message.UserPicture,
+		Text:          message.Text,
+		Voice:         voice,
+		AudioID:       message.AudioID,
+		Outcome:       outcome,
+		CreatedAt:     now,
+	}
+	if outcome == outcomeDelivered {
+		entry.DeliveredAt = &now
+	}
+	return entry
+}
+
+// historyFilter selects entries of the history page.
+type historyFilter struct {
+	Query    string
+	SenderID string
+	Outcome  string
+}
+
+func (f historyFilter) match(entry *historyEntry) bool {
+	if f.SenderID != "" && entry.SenderID != f.SenderID {
+		return false
+	}
+	if f.Outcome != "" && entry.Outcome != f.Outcome {
+		return false
+	}
+	if f.Query != "" {
+		query := strings.ToLower(f.Query)
+		return strings.Contains(strings.ToLower(entry.Text), query) ||
+			strings.Contains(strings.ToLower(entry.SenderName), query)
+	}
+	return true
+}
+
+// messageHistory keeps the messages of each channel in Redis: a hash of
+// entries by message ID, indexed by a sorted set scored by creation time.
+type messageHistory struct {
+	redisConn *redis.Client
+}
+
+func newMessageHistory(redisConn *redis.Client) *messageHistory {
+	return &messageHistory{redisConn: redisConn}
+}
+
+func historyKey(channelID string) string {
+	return "history:" + channelID
+}
+
+func historyIndexKey(channelID string) string {
+	return "history-index:" + channelID
+}
+
+// Add records entry and drops what is past the retention of the channel.
+func (h *messageHistory) Add(ctx context.Context, entry *historyEntry, retention time.Duration) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pipe := h.redisConn.TxPipeline()
+	pipe.HSet(ctx, historyKey(entry.ChannelID), entry.ID, b)
+	pipe.ZAdd(ctx, historyIndexKey(entry.ChannelID), &redis.Z{
+		Score:  float64(entry.CreatedAt.UnixNano() / int64(time.Millisecond)),
+		Member: entry.ID,
+	})
+	if _, err = pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return h.prune(ctx, entry.ChannelID, retention)
+}
+
+func (h *messageHistory) prune(ctx context.Context, channelID string, retention time.Duration) error {
+	index := historyIndexKey(channelID)
+	cutoff := time.Now().Add(-retention).UnixNano() / int64(time.Millisecond)
+	expired, err := h.redisConn.ZRangeByScore(ctx, index, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(cutoff, 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	excess, err := h.redisConn.ZRange(ctx, index, 0, int64(-historyMaxEntries-1)).Result()
+	if err != nil {
+		return err
+	}
+	drop := append(expired, excess...)
+	if len(drop) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(drop))
+	for i, id := range drop {
+		members[i] = id
+	}
+	pipe := h.redisConn.TxPipeline()
+	pipe.ZRem(ctx, index, members...)
+	pipe.HDel(ctx, historyKey(channelID), drop...)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get returns an entry, or redis.Nil.
+func (h *messageHistory) Get(ctx context.Context, channelID, messageID string) (*historyEntry, error) {
+	b, err := h.redisConn.HGet(ctx, historyKey(channelID), messageID).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var entry historyEntry
+	return &entry, json.Unmarshal(b, &entry)
+}
+
+// Update changes an entry, if it is still in the history.
+func (h *messageHistory) Update(ctx context.Context, channelID, messageID string, update func(*historyEntry)) error {
+	entry, err := h.Get(ctx, channelID, messageID)
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	update(entry)
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return h.redisConn.HSet(ctx, historyKey(channelID), messageID, b).Err()
+}
+
+// SetOutcome records what became of a message.
+func (h *messageHistory) SetOutcome(ctx context.Context, channelID, messageID, outcome string) {
+	err := h.Update(ctx, channelID, messageID, func(entry *historyEntry) {
+		now := time.Now()
+		entry.Outcome = outcome
+		switch outcome {
+		case outcomeDelivered:
+			entry.DeliveredAt = &now
+		case outcomePlayed:
+			entry.PlayedAt = &now
+		}
+	})
+	if err != nil {
+		slog.Error("setting history outcome", logChannelID, channelID, logMessageID, messageID, "outcome", outcome, "error", err)
+	}
+}
+
+// Search returns up to limit entries matching filter, the newest first.
+func (h *messageHistory) Search(ctx context.Context, channelID string, filter historyFilter, limit int) ([]*historyEntry, error) {
+	ids, err := h.redisConn.ZRevRange(ctx, historyIndexKey(channelID), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	values, err := h.redisConn.HMGet(ctx, historyKey(channelID), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*historyEntry
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var entry historyEntry
+		if json.Unmarshal([]byte(s), &entry) != nil || !filter.match(&entry) {
+			continue
+		}
+		entries = append(entries, &entry)
+		if len(entries) == limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// HandleHistory shows the history of the logged-in channel, filtered by the
+// query parameters q (text or sender name), viewer (sender ID) and outcome.
+func HandleHistory(history *messageHistory, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardAccess(w, r, moderators, permHistory)
+	if !ok {
+		return
+	}
+	session, _ := cookieStore.Get(r, oauthSessionName)
+	flashes := session.Flashes()
+	if len(flashes) > 0 {
+		if err := session.Save(r, w); err != nil {
+			slog.Error("saving session", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		}
+	}
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		slog.Error("creating csrf token", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := historyFilter{
+		Query:    strings.TrimSpace(query.Get("q")),
+		SenderID: query.Get("viewer"),
+		Outcome:  query.Get("outcome"),
+	}
+	entries, err := history.Search(r.Context(), user.ChannelID, filter, historyPageSize)
+	if err != nil {
+		slog.Error("searching history", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("history").Parse(historyHTML)
+	if err != nil {
+		slog.Error("parsing history template", "error", err)
+		return
+	}
+	parsed := bytes.NewBufferString("")
+	err = tmpl.Execute(parsed, struct {
+		CSRFToken string
+		Flashes   []interface{}
+		Filter    historyFilter
+		Query     string
+		Outcomes  []string
+		Names     map[string]string
+		Durations []blockDuration
+		Entries   []*historyEntry
+	}{
+		CSRFToken: csrf,
+		Flashes:   flashes,
+		Filter:    filter,
+		Query:     url.Values{"q": {filter.Query}, "viewer": {filter.SenderID}, "outcome": {filter.Outcome}}.Encode(),
+		Outcomes:  historyOutcomes,
+		Names:     outcomeNames,
+		Durations: blockDurations,
+		Entries:   entries,
+	})
+	if err != nil {
+		slog.Error("rendering history", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(parsed.Bytes())
+}
+
+// HandleHistoryReplay sends a message of the history to the overlay again.
+func HandleHistoryReplay(hub *Hub, redisConn *redis.Client, history *messageHistory, emoteCache *emoteCache, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permHistory)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	back := "/history?" + r.PostFormValue("filter")
+
+	entry, err := history.Get(ctx, user.ChannelID, r.PostFormValue("id"))
+	if err == redis.Nil || (err == nil && entry.AudioID == "") {
+		addFlash(w, r, "Essa mensagem não pode ser tocada de novo.")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		slog.Error("loading history entry", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := redisConn.Exists(ctx, entry.AudioID).Result(); err != nil || n == 0 {
+		addFlash(w, r, "O áudio dessa mensagem já expirou.")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if _, found := hub.Overlay(user.ChannelID); !found {
+		addFlash(w, r, "Nenhum overlay conectado: a mensagem vai tocar quando ele conectar.")
+	} else {
+		addFlash(w, r, "Mensagem enviada de novo para o overlay.")
+	}
+
+	message := &Message{
+		ID:          entry.ID,
+		AudioID:     entry.AudioID,
+		ClientID:    user.ChannelID,
+		Text:        entry.Text,
+		Emotes:      emoteCache.Get(user.ChannelID),
+		UserName:    entry.SenderName,
+		UserPicture: entry.SenderPicture,
+	}
+	deliver(ctx, hub, redisConn, message)
+	audit.Record(ctx, user.UserID, user.ChannelID, auditReplay, entry.ID, nil, auditedMessage(message))
+	slog.Info("message replayed", logChannelID, user.ChannelID, logUserID, user.UserID, logMessageID, entry.ID)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
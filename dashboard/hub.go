@@ -5,32 +5,100 @@
 package main
 
 import (
-	"log"
-	"strings"
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/nicklaw5/helix"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Message struct {
-	ClientID    string            `json:"client_id"`
-	AudioURL    string            `json:"audio_url"`
-	Text        string            `json:"text"`
-	Emotes      map[string]string `json:"emotes"`
-	UserName    string            `json:"username"`
-	UserPicture string            `json:"user_picture"`
+	ID          string `json:"id"`
+	AudioID     string `json:"audio_id"`
+	Seq         uint64 `json:"seq"`
+	ClientID    string `json:"client_id"`
+	AudioURL    string `json:"audio_url"`
+	Text        string `json:"text"`
+	Emotes      Emotes `json:"emotes"`
+	UserName    string `json:"username"`
+	UserPicture string `json:"user_picture"`
+
+	// ID HandleTTS gave the request that created the message, so the
+	// overlay can log it too.
+	RequestID string `json:"request_id,omitempty"`
+
+	// Inline audio, only for overlays that support capInlineAudio.
+	AudioData []byte `json:"audio_data,omitempty"`
+	AudioType string `json:"audio_type,omitempty"`
+
+	// Inline audio loaded by deliver, by audio format name; each overlay
+	// gets the one in its own format.
+	inlineAudio map[string]inlineAudio
+
+	// Span of the delivery, continued by the hub.
+	spanContext trace.SpanContext
+}
+
+type inlineAudio struct {
+	data        []byte
+	contentType string
+}
+
+// forClient returns message as client gets it: with the audio inline, in
+// the format it asked for, when it plays audio inline.
+func (m *Message) forClient(client *Client) *Message {
+	if !client.Supports(capInlineAudio) {
+		return m
+	}
+	audio, ok := m.inlineAudio[client.AudioFormat().Name]
+	if !ok {
+		return m
+	}
+	inline := *m
+	inline.AudioData, inline.AudioType = audio.data, audio.contentType
+	return &inline
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Registered clients.
-	clients map[string]*Client
+	// Registered clients, by channel. Only run changes it, holding mu;
+	// everyone else reads it through the methods below.
+	mu      sync.RWMutex
+	clients map[string]map[*Client]bool
+
+	// Dashboards watching the presence of each channel.
+	watchMutex sync.Mutex
+	watchers   map[string]map[chan struct{}]bool
+
+	// Recent messages of each channel, replayed to reconnecting overlays.
+	// Channels with nothing recent are dropped, so seq numbers the
+	// messages of all of them.
+	backlogs map[string]*backlog
+	seq      uint64
+
+	// Where played messages are recorded.
+	history *messageHistory
+
+	// Identifies this run of the hub, so overlays can tell whether the
+	// sequence numbers they saw still mean anything.
+	epoch string
 
 	// Inbound messages from the clients.
 	broadcast chan *Message
 
+	// Envelopes sent by the overlays.
+	inbound chan *inboundMessage
+
+	// Envelopes for the overlay of a channel, other than messages.
+	notify chan *channelEnvelope
+
 	// Register requests from the clients.
 	register chan *Client
 
@@ -54,78 +122,196 @@ var (
 		Name: "vox_twitch_connected_users_total",
 		Help: "The total number of connected users",
 	})
-	ttsGenerated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	ttsGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "vox_twitch_generated_tts_total",
 		Help: "The total number of tts messages spoken",
 	}, []string{"channel_id"},
 	)
 )
 
-func newHub() *Hub {
+func newHub(history *messageHistory) *Hub {
 	return &Hub{
+		history:    history,
 		broadcast:  make(chan *Message),
+		inbound:    make(chan *inboundMessage),
+		notify:     make(chan *channelEnvelope),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		clients:    make(map[string]*Client),
+		clients:    make(map[string]map[*Client]bool),
+		watchers:   make(map[string]map[chan struct{}]bool),
+		backlogs:   make(map[string]*backlog),
+		epoch:      uuid.New().String(),
 	}
 }
 
 func (h *Hub) run() {
+	pruneTicker := time.NewTicker(time.Minute)
+	defer pruneTicker.Stop()
 	for {
 		usersConnected.Set(float64(len(h.clients)))
 		select {
 		case client := <-h.register:
-			h.clients[client.id] = client
+			h.mu.Lock()
+			if h.clients[client.id] == nil {
+				h.clients[client.id] = make(map[*Client]bool)
+			}
+			h.clients[client.id][client] = true
+			h.mu.Unlock()
+			websocketConnects.WithLabelValues(client.role).Inc()
+			h.changed(client.id)
 			h.printStatus()
 		case client := <-h.unregister:
-			if c, ok := h.clients[client.id]; ok {
-				if c.amqpChan != nil {
-					c.amqpChan.Close()
-				}
-				if c.amqpConn != nil {
-					c.amqpConn.Close()
-				}
-				delete(h.clients, client.id)
-				close(client.send)
+			if h.clients[client.id][client] {
+				h.remove(client)
 				h.printStatus()
 			}
 		case message := <-h.broadcast:
-			client := h.clients[message.ClientID]
-			select {
-			case client.send <- message:
-				ttsGenerated.With(prometheus.Labels{"channel_id": client.id}).Inc()
-			default:
-				close(client.send)
-				delete(h.clients, client.id)
+			_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), message.spanContext), "hub.broadcast",
+				trace.WithAttributes(attribute.Int("hub.clients", len(h.clients[message.ClientID]))))
+			h.seq++
+			message.Seq = h.seq
+			h.backlog(message.ClientID).add(message)
+			// overlay offline: it gets the message when it reconnects
+			for client := range h.clients[message.ClientID] {
+				m := message.forClient(client)
+				select {
+				case client.send <- newEnvelope(typeMessage, m):
+					slog.Debug("message sent", logRequestID, m.RequestID, logChannelID, client.id,
+						logMessageID, m.ID, "role", client.role, "seq", m.Seq)
+					if client.role == roleOverlay {
+						ttsGenerated.With(prometheus.Labels{"channel_id": client.id}).Inc()
+					}
+				default:
+					slog.Warn("client too slow, disconnecting", logRequestID, m.RequestID, logChannelID, client.id,
+						logMessageID, m.ID, "role", client.role)
+					span.AddEvent("client dropped", trace.WithAttributes(attribute.String("role", client.role)))
+					h.remove(client)
+				}
+			}
+			span.End()
+		case in := <-h.inbound:
+			h.route(in)
+		case n := <-h.notify:
+			for client := range h.clients[n.channelID] {
+				// lembra para mandar de novo se o overlay reconectar
+				if settings, ok := n.envelope.Payload.(overlaySettings); ok {
+					client.settings = settings
+				}
+				h.reply(client, n.envelope)
 			}
+		case <-pruneTicker.C:
+			h.pruneBacklogs()
 		}
 	}
 }
 
-func (h *Hub) printStatus() {
-	log.Println("Canais:\n------------\n",
-		strings.Join(clientIDs(h.clients), "\n"))
+// remove forgets client and closes its connections. Only run calls it.
+func (h *Hub) remove(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client.amqpChan != nil {
+		client.amqpChan.Close()
+	}
+	if client.amqpConn != nil {
+		client.amqpConn.Close()
+	}
+	delete(h.clients[client.id], client)
+	if len(h.clients[client.id]) == 0 {
+		delete(h.clients, client.id)
+	}
+	close(client.send)
+	websocketDisconnects.WithLabelValues(client.role).Inc()
+	if client.role == roleOverlay {
+		overlayQueueLength.DeleteLabelValues(client.id)
+	}
+	h.changed(client.id)
+}
+
+// Clients returns the clients connected to channelID.
+func (h *Hub) Clients(channelID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients[channelID]))
+	for client := range h.clients[channelID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Overlay returns an overlay of channelID, the channel being offline when
+// there is none. Previews don't count.
+func (h *Hub) Overlay(channelID string) (*Client, bool) {
+	for _, client := range h.Clients(channelID) {
+		if client.role == roleOverlay {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+func (h *Hub) backlog(channelID string) *backlog {
+	b, ok := h.backlogs[channelID]
+	if !ok {
+		b = &backlog{}
+		h.backlogs[channelID] = b
+	}
+	return b
 }
 
-func (h *Hub) Online(client *helix.Client) (online []TwitchUser) {
-	resp, err := client.GetUsers(&helix.UsersParams{IDs: clientIDs(h.clients)})
-	if err != nil {
-		return
+// pruneBacklogs drops the backlogs of the channels with nothing recent.
+func (h *Hub) pruneBacklogs() {
+	for channelID, b := range h.backlogs {
+		if b.empty() {
+			delete(h.backlogs, channelID)
+		}
+	}
+}
+
+// replay sends c everything broadcast to its channel after lastSeq. When
+// the overlay saw a previous epoch, the whole backlog is sent. The audio
+// URLs are signed again, as they may have expired since.
+func (h *Hub) replay(c *Client, epoch string, lastSeq uint64) {
+	if epoch != h.epoch {
+		lastSeq = 0
+	}
+	for _, message := range h.backlogs[c.id].since(lastSeq) {
+		replayed := *message
+		replayed.AudioURL = playbackURL(message.AudioID, message.ClientID)
+		h.reply(c, newEnvelope(typeMessage, &replayed))
 	}
-	for _, user := range resp.Data.Users {
+}
+
+func (h *Hub) printStatus() {
+	slog.Info("channels online", "channels", h.onlineIDs())
+}
+
+func (h *Hub) Online(ctx context.Context, profiles *profileCache) (online []TwitchUser) {
+	ids := h.onlineIDs()
+	found := profiles.Lookup(ctx, ids)
+	for _, id := range ids {
+		user := found[id]
 		online = append(online, TwitchUser{
 			DisplayName: user.DisplayName,
 			Name:        user.Login,
-			Logo:        user.ProfileImageURL,
+			Logo:        user.Picture,
 		})
 	}
 	return
 }
 
-func clientIDs(clients map[string]*Client) (keys []string) {
-	keys = make([]string, 0, len(clients))
-	for k := range clients {
-		keys = append(keys, k)
+// onlineIDs returns the channels with an overlay connected.
+func (h *Hub) onlineIDs() (ids []string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids = make([]string, 0, len(h.clients))
+	for id, clients := range h.clients {
+		for client := range clients {
+			if client.role == roleOverlay {
+				ids = append(ids, id)
+				break
+			}
+		}
 	}
+	sort.Strings(ids)
 	return
 }
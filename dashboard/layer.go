@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Where the cards show up on the layer.
+var layerPositions = []string{"top-right", "top-left", "bottom-right", "bottom-left"}
+
+var (
+	hexColor       = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+	fontFamily     = regexp.MustCompile(`^[\pL\pN ._-]{1,64}$`)
+	layerThemeName = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+)
+
+const maxLayerThemes = 20
+
+// layerTheme is how the overlay looks and behaves on a scene. It comes from
+// the parameters of the layer URL, optionally on top of a theme the
+// streamer saved on the dashboard.
+type layerTheme struct {
+	Position     string `json:"position"`
+	Background   string `json:"background,omitempty"`
+	Color        string `json:"color,omitempty"`
+	Font         string `json:"font,omitempty"`
+	FontSize     int    `json:"font_size"`
+	Width        int    `json:"width"`
+	MaxCards     int    `json:"max_cards"`
+	CardLifetime int    `json:"card_lifetime"`
+	ShowAvatar   bool   `json:"show_avatar"`
+}
+
+// namedLayerTheme is a layerTheme saved on the dashboard.
+type namedLayerTheme struct {
+	Name string
+	layerTheme
+}
+
+func defaultLayerTheme() layerTheme {
+	return layerTheme{
+		Position:     layerPositions[0],
+		FontSize:     32,
+		Width:        25,
+		CardLifetime: 3,
+		ShowAvatar:   true,
+	}
+}
+
+// apply overrides the theme with the parameters present in values, e.g.
+// "?position=bottom-left&background=%23000000cc&font-size=24". Invalid
+// parameters are skipped; the first of them is returned as error.
+func (t *layerTheme) apply(values url.Values) error {
+	var first error
+	fail := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	number := func(name string, min, max int, field *int) {
+		if value := values.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < min || n > max {
+				fail(fmt.Errorf("%s deve ficar entre %d e %d", name, min, max))
+				return
+			}
+			*field = n
+		}
+	}
+	color := func(name string, field *string) {
+		if value := values.Get(name); value != "" {
+			if !hexColor.MatchString(value) {
+				fail(fmt.Errorf("%s deve ser uma cor como #8c35f399", name))
+				return
+			}
+			*field = "#" + strings.TrimPrefix(value, "#")
+		}
+	}
+
+	if position := values.Get("position"); position != "" {
+		if contains(layerPositions, position) {
+			t.Position = position
+		} else {
+			fail(fmt.Errorf("posição desconhecida: %q", position))
+		}
+	}
+	color("background", &t.Background)
+	color("color", &t.Color)
+	if font := values.Get("font"); font != "" {
+		if fontFamily.MatchString(font) {
+			t.Font = font
+		} else {
+			fail(fmt.Errorf("fonte inválida: %q", font))
+		}
+	}
+	number("font-size", 8, 128, &t.FontSize)
+	number("width", 10, 100, &t.Width)
+	number("max-cards", 0, 20, &t.MaxCards)
+	number("card-lifetime", 0, 600, &t.CardLifetime)
+	if showAvatar := values.Get("show-avatar"); showAvatar != "" {
+		if show, err := strconv.ParseBool(showAvatar); err == nil {
+			t.ShowAvatar = show
+		} else {
+			fail(fmt.Errorf("show-avatar deve ser true ou false"))
+		}
+	}
+	return first
+}
+
+// Style renders the theme as the CSS variables layer.html uses. Everything
+// in it went through apply, so it is safe to inline.
+func (t layerTheme) Style() template.CSS {
+	style := fmt.Sprintf("--font-size: %dpx; --column-width: %d%%;", t.FontSize, t.Width)
+	if t.Background != "" {
+		style += " --card-background: " + t.Background + ";"
+	}
+	if t.Color != "" {
+		style += " --text-color: " + t.Color + ";"
+	}
+	if t.Font != "" {
+		style += fmt.Sprintf(" --font-family: %q, Helvetica, Arial, sans-serif;", t.Font)
+	}
+	return template.CSS(style)
+}
+
+func layerThemesKey(channelID string) string {
+	return "layer-themes:" + channelID
+}
+
+// loadLayerTheme returns the theme channelID saved as name, or redis.Nil.
+func loadLayerTheme(ctx context.Context, redisConn *redis.Client, channelID, name string) (layerTheme, error) {
+	theme := defaultLayerTheme()
+	b, err := redisConn.HGet(ctx, layerThemesKey(channelID), name).Bytes()
+	if err != nil {
+		return theme, err
+	}
+	return theme, json.Unmarshal(b, &theme)
+}
+
+func saveLayerTheme(ctx context.Context, redisConn *redis.Client, channelID, name string, theme layerTheme) error {
+	if !layerThemeName.MatchString(name) {
+		return fmt.Errorf("o nome do tema deve ter só letras minúsculas, números e hífens")
+	}
+	n, err := redisConn.HLen(ctx, layerThemesKey(channelID)).Result()
+	if err != nil {
+		return err
+	}
+	if exists, _ := redisConn.HExists(ctx, layerThemesKey(channelID), name).Result(); !exists && n >= maxLayerThemes {
+		return fmt.Errorf("no máximo %d temas", maxLayerThemes)
+	}
+	b, err := json.Marshal(theme)
+	if err != nil {
+		return err
+	}
+	return redisConn.HSet(ctx, layerThemesKey(channelID), name, b).Err()
+}
+
+func deleteLayerTheme(ctx context.Context, redisConn *redis.Client, channelID, name string) error {
+	return redisConn.HDel(ctx, layerThemesKey(channelID), name).Err()
+}
+
+// listLayerThemes returns the themes saved by channelID, by name.
+func listLayerThemes(ctx context.Context, redisConn *redis.Client, channelID string) ([]namedLayerTheme, error) {
+	values, err := redisConn.HGetAll(ctx, layerThemesKey(channelID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	themes := make([]namedLayerTheme, 0, len(values))
+	for name, value := range values {
+		theme := namedLayerTheme{Name: name, layerTheme: defaultLayerTheme()}
+		if json.Unmarshal([]byte(value), &theme.layerTheme) == nil {
+			themes = append(themes, theme)
+		}
+	}
+	sort.Slice(themes, func(i, j int) bool { return themes[i].Name < themes[j].Name })
+	return themes, nil
+}
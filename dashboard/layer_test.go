@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLayerThemeApply(t *testing.T) {
+	// tema salvo no dashboard, sobre o qual vão os parâmetros da url
+	saved := defaultLayerTheme()
+	saved.Position = "bottom-left"
+	saved.Background = "#000000cc"
+	saved.FontSize = 24
+
+	tests := []struct {
+		name    string
+		query   string
+		want    func(*layerTheme)
+		wantErr bool
+	}{
+		{name: "no parameters keep the theme", query: ""},
+		{name: "valid parameters", query: "position=top-left&background=ff0000&color=%23fff&font=Comic+Sans&font-size=48&width=50&max-cards=5&card-lifetime=10&show-avatar=false",
+			want: func(t *layerTheme) {
+				t.Position, t.Background, t.Color, t.Font = "top-left", "#ff0000", "#fff", "Comic Sans"
+				t.FontSize, t.Width, t.MaxCards, t.CardLifetime, t.ShowAvatar = 48, 50, 5, 10, false
+			}},
+		{name: "unknown position falls back to the theme", query: "position=middle", wantErr: true},
+		{name: "invalid color falls back to the theme", query: "background=red", wantErr: true},
+		{name: "css in the font", query: "font=x%3B}body{display:none", wantErr: true},
+		{name: "font size out of range", query: "font-size=500", wantErr: true},
+		{name: "width not a number", query: "width=abc", wantErr: true},
+		{name: "invalid show-avatar", query: "show-avatar=talvez", wantErr: true},
+		{name: "invalid parameters don't stop the valid ones", query: "font-size=1&width=40", wantErr: true,
+			want: func(t *layerTheme) { t.Width = 40 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := saved
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			got := saved
+			if err = got.apply(values); (err != nil) != tt.wantErr {
+				t.Errorf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != want {
+				t.Errorf("apply() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
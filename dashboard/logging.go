@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Log fields shared by every log line about a viewer message, so one can be
+// followed from HandleTTS to the TTS worker, the hub and the overlay.
+const (
+	logRequestID = "request_id"
+	logChannelID = "channel_id"
+	logUserID    = "user_id"
+	logMessageID = "message_id"
+)
+
+// setupLogging makes every log line a JSON object on stderr, those of the
+// log package included, which are logged at info level. LOG_LEVEL (debug,
+// info, warn or error) sets the minimum level logged.
+func setupLogging() {
+	var level slog.LevelVar
+	err := level.UnmarshalText([]byte(envString("LOG_LEVEL", "info")))
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &level})))
+	if err != nil {
+		slog.Warn("invalid LOG_LEVEL, using info", "error", err)
+	}
+}
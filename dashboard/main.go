@@ -19,13 +19,18 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"encoding/gob"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/nicklaw5/helix"
@@ -33,44 +38,175 @@ import (
 )
 
 func main() {
+	setupLogging()
+	shutdownTracing := setupTracing(context.Background())
+	go func() {
+		// manda os spans que faltam antes de sair
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("flushing traces", "error", err)
+		}
+		os.Exit(0)
+	}()
+
+	var err error
+	if playbackSecret, err = loadPlaybackSecret(); err != nil {
+		slog.Error("playback secret", "error", err)
+		os.Exit(1)
+	}
+	if extensionSecret, err = loadExtensionSecret(); err != nil {
+		slog.Error("extension secret", "error", err)
+		os.Exit(1)
+	}
+	ffmpegPath = lookupFFmpeg()
+	quotaLocation = loadQuotaLocation(envString("QUOTA_TIMEZONE", "America/Sao_Paulo"))
+	if cookieStore, err = newCookieStore(); err != nil {
+		slog.Error("session cookies", "error", err)
+		os.Exit(1)
+	}
+
 	// Gob encoding for helix/AccessCredentials
 	gob.Register(&helix.AccessCredentials{})
 
-	hub := newHub()
-	go hub.run()
-
 	redisURL := os.Getenv("REDIS_URL")
 	if !strings.HasSuffix(redisURL, ":6379") {
 		redisURL = redisURL + ":6379"
 	}
 	redisConn := redis.NewClient(&redis.Options{Addr: redisURL})
+	redisConn.AddHook(redisTracing{})
+
+	history := newMessageHistory(redisConn)
+	hub := newHub(history)
+	go hub.run()
+
+	twitch, err := newTwitchAPI(clientID, clientSecret, redirectURL)
+	if err != nil {
+		slog.Error("twitch api", "error", err)
+		os.Exit(1)
+	}
+	profiles := newProfileCache(redisConn, twitch, envDuration("PROFILE_CACHE_TTL", 24*time.Hour))
+	extConfig := newExtensionConfig(twitch)
+	channels := newChannelRegistry(redisConn)
+	moderators := newModeratorList(redisConn, twitch, channels)
+	audit := newAuditLog(redisConn)
+	quotas := newQuotaTracker(redisConn)
+	emoteCache := newEmoteCache(envDuration("EMOTE_CACHE_TTL", 30*time.Minute), twitch.App)
 
 	mux := http.DefaultServeMux
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		HandleRoot(hub, w, r)
+		HandleRoot(hub, redisConn, twitch, profiles, moderators, channels, quotas, w, r)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		HandleLogin(twitch, w, r)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		HandleOAuth2Callback(twitch, w, r)
 	})
-	mux.HandleFunc("/login", HandleLogin)
-	mux.HandleFunc("/redirect", HandleOAuth2Callback)
 	mux.HandleFunc("/logout", HandleLogout)
-	mux.HandleFunc("/layer/", HandleLayer)
+	mux.HandleFunc("/layer/", func(w http.ResponseWriter, r *http.Request) {
+		HandleLayer(redisConn, w, r)
+	})
+	mux.HandleFunc("/emotes/refresh", func(w http.ResponseWriter, r *http.Request) {
+		HandleRefreshEmotes(emoteCache, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
+		HandleSaveSettings(hub, redisConn, extConfig, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/layer-themes", func(w http.ResponseWriter, r *http.Request) {
+		HandleLayerThemes(redisConn, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+		HandleTestMessage(hub, redisConn, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/status/events", func(w http.ResponseWriter, r *http.Request) {
+		HandleStatusEvents(hub, moderators, w, r)
+	})
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		HandleHistory(history, moderators, w, r)
+	})
+	mux.HandleFunc("/history/replay", func(w http.ResponseWriter, r *http.Request) {
+		HandleHistoryReplay(hub, redisConn, history, emoteCache, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request) {
+		HandleAudit(audit, profiles, moderators, w, r)
+	})
+	mux.HandleFunc("/audit/export", func(w http.ResponseWriter, r *http.Request) {
+		HandleAuditExport(audit, moderators, w, r)
+	})
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		HandleAdmin(hub, redisConn, channels, quotas, profiles, moderators, w, r)
+	})
+	mux.HandleFunc("/admin/channel", func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminChannel(hub, redisConn, extConfig, channels, quotas, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		HandleBlocklist(redisConn, profiles, audit, moderators, w, r)
+	})
+	mux.HandleFunc("/api/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		HandleBlocklistAPI(redisConn, profiles, audit, w, r)
+	})
+	mux.HandleFunc("/moderators", func(w http.ResponseWriter, r *http.Request) {
+		HandleModerators(moderators, profiles, audit, w, r)
+	})
+	mux.HandleFunc("/channel", func(w http.ResponseWriter, r *http.Request) {
+		HandleSwitchChannel(moderators, w, r)
+	})
+	mux.HandleFunc("/pending", func(w http.ResponseWriter, r *http.Request) {
+		HandleApproval(hub, redisConn, history, audit, moderators, w, r)
+	})
 	mux.Handle("/metrics", promhttp.Handler())
 
 	mux.HandleFunc("/ws/", func(w http.ResponseWriter, r *http.Request) {
-		HandleWebsocket(hub, w, r)
+		HandleWebsocket(hub, redisConn, emoteCache, channels, w, r)
 	})
 	mux.HandleFunc("/tts/", func(w http.ResponseWriter, r *http.Request) {
-		HandleTTS(hub, w, r)
+		HandleTTS(hub, redisConn, history, profiles, emoteCache, channels, quotas, w, r)
+	})
+	mux.HandleFunc("/extension/config", func(w http.ResponseWriter, r *http.Request) {
+		HandleExtensionConfig(hub, redisConn, extConfig, audit, w, r)
 	})
 	mux.HandleFunc("/ttsPlay/", func(w http.ResponseWriter, r *http.Request) {
 		HandleTTSPlay(redisConn, w, r)
 	})
 	mux.HandleFunc("/elm.min.js", func(w http.ResponseWriter, r *http.Request) {
 		if _, err := w.Write(elmMinJs); err != nil {
-			log.Println("main > elm.min.js:", err)
+			slog.Error("serving elm.min.js", "error", err)
 			return
 		}
 	})
 
 	fmt.Println("Started running on :7001")
-	fmt.Println(http.ListenAndServe(":7001", nil))
+	fmt.Println(http.ListenAndServe(":7001", traceRoutes(mux, instrumentRoutes(mux))))
+}
+
+func envString(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
 }
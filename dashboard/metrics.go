@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	ttsRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vox_twitch_tts_requests_total",
+		Help: "The total number of TTS requests, by outcome: delivered, pending or why it was refused",
+	}, []string{"outcome"},
+	)
+	ttsSynthesisDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "vox_twitch_tts_synthesis_duration_seconds",
+		Help:    "How long generating the audio of a message took, retries included",
+		Buckets: []float64{.25, .5, 1, 2, 4, 8, 15, 30, 60, 120},
+	})
+	amqpRoundTrip = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vox_twitch_amqp_round_trip_seconds",
+		Help:    "Time from publishing a request to the TTS worker to its reply, or to giving up",
+		Buckets: []float64{.1, .25, .5, 1, 2, 4, 8, 15, 30, 60, 300},
+	}, []string{"result"},
+	)
+	overlayQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vox_twitch_overlay_queue_length",
+		Help: "Messages waiting to be played, as reported by the overlay of each channel",
+	}, []string{"channel_id"},
+	)
+	websocketConnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vox_twitch_websocket_connects_total",
+		Help: "The total number of websocket connections, by client role",
+	}, []string{"role"},
+	)
+	websocketDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vox_twitch_websocket_disconnects_total",
+		Help: "The total number of websocket disconnections, by client role",
+	}, []string{"role"},
+	)
+	audioSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vox_twitch_audio_size_bytes",
+		Help:    "Size of the audio stored in Redis: as the TTS worker generated it, or transcoded",
+		Buckets: prometheus.ExponentialBuckets(16<<10, 2, 10),
+	}, []string{"format"},
+	)
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vox_twitch_upstream_requests_total",
+		Help: "The total number of requests to Twitch and the emote providers, by status code or \"error\"",
+	}, []string{"service", "host", "code"},
+	)
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vox_twitch_upstream_request_duration_seconds",
+		Help:    "How long requests to Twitch and the emote providers took",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "host"},
+	)
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vox_twitch_http_request_duration_seconds",
+		Help:    "How long the HTTP handlers took, by route; websockets and event streams last as long as the connection",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"},
+	)
+)
+
+// instrumentedTransport records the latency and the outcome of the requests
+// made to service.
+type instrumentedTransport struct {
+	service string
+	next    http.RoundTripper
+}
+
+func newInstrumentedTransport(service string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &instrumentedTransport{service: service, next: next}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	upstreamDuration.WithLabelValues(t.service, req.URL.Host).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamRequests.WithLabelValues(t.service, req.URL.Host, code).Inc()
+	return resp, err
+}
+
+// instrumentRoutes records how long each request to mux took, labeled by
+// the pattern it matched, so the routes with path parameters don't blow up
+// the label count.
+func instrumentRoutes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		observer := httpDuration.MustCurryWith(prometheus.Labels{"route": route})
+		promhttp.InstrumentHandlerDuration(observer, mux).ServeHTTP(w, r)
+	})
+}
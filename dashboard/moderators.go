@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nicklaw5/helix"
+)
+
+const channelIDKey = "channel-id"
+
+// Where a moderator of the dashboard came from.
+const (
+	moderatorManual = "manual"
+	moderatorTwitch = "twitch"
+)
+
+// permission is something a role can do on the dashboard of a channel.
+type permission string
+
+const (
+	permSettings   permission = "settings"
+	permModerators permission = "moderators"
+	permQueue      permission = "queue"
+	permFilters    permission = "filters"
+	permBlocklist  permission = "blocklist"
+	permHistory    permission = "history"
+	permStatus     permission = "status"
+	permAudit      permission = "audit"
+	// permOperate belongs to the operators of the service, whatever the
+	// channel.
+	permOperate permission = "operate"
+)
+
+// rolePermissions is what each dashboard role can do: moderators take care
+// of the messages, the rest stays with the broadcaster.
+var rolePermissions = map[string][]permission{
+	roleBroadcaster: {permSettings, permModerators, permQueue, permFilters, permBlocklist, permHistory, permStatus, permAudit},
+	roleModerator:   {permQueue, permFilters, permBlocklist, permHistory, permStatus},
+}
+
+var (
+	errNoSession    = errors.New("not logged in")
+	errInvalidToken = errors.New("access token invalid or of another app")
+	errNotModerator = errors.New("not a moderator of the channel")
+)
+
+// dashboardUser is who is logged in, which channel they are managing and
+// as what.
+type dashboardUser struct {
+	UserID    string
+	ChannelID string
+	Role      string
+	Operator  bool
+}
+
+// Can tells whether the user's role allows perm.
+func (u dashboardUser) Can(perm permission) bool {
+	if perm == permOperate {
+		return u.Operator
+	}
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// moderator is someone the broadcaster let into the dashboard of their
+// channel.
+type moderator struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// moderatorList keeps the moderators of each channel in Redis, along with
+// the channels each user moderates, so they can pick one after logging in.
+type moderatorList struct {
+	redisConn *redis.Client
+	twitch    *twitchAPI
+	channels  *channelRegistry
+
+	// Owners of the access tokens Twitch validated lately.
+	tokensMutex sync.Mutex
+	tokens      map[string]validatedToken
+}
+
+// tokenValidationTTL is how long Twitch's word on who owns an access token
+// is taken.
+const tokenValidationTTL = 5 * time.Minute
+
+type validatedToken struct {
+	userID string
+	until  time.Time
+}
+
+func newModeratorList(redisConn *redis.Client, twitch *twitchAPI, channels *channelRegistry) *moderatorList {
+	return &moderatorList{redisConn: redisConn, twitch: twitch, channels: channels, tokens: make(map[string]validatedToken)}
+}
+
+func moderatorsKey(channelID string) string {
+	return "moderators:" + channelID
+}
+
+func moderatingKey(userID string) string {
+	return "moderating:" + userID
+}
+
+func (m *moderatorList) Add(ctx context.Context, channelID string, mod *moderator) error {
+	b, err := json.Marshal(mod)
+	if err != nil {
+		return err
+	}
+	pipe := m.redisConn.TxPipeline()
+	pipe.HSet(ctx, moderatorsKey(channelID), mod.ID, b)
+	pipe.SAdd(ctx, moderatingKey(mod.ID), channelID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (m *moderatorList) Remove(ctx context.Context, channelID, userID string) error {
+	pipe := m.redisConn.TxPipeline()
+	pipe.HDel(ctx, moderatorsKey(channelID), userID)
+	pipe.SRem(ctx, moderatingKey(userID), channelID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Is tells whether userID moderates the dashboard of channelID.
+func (m *moderatorList) Is(ctx context.Context, channelID, userID string) (bool, error) {
+	return m.redisConn.HExists(ctx, moderatorsKey(channelID), userID).Result()
+}
+
+// List returns the moderators of channelID, by name.
+func (m *moderatorList) List(ctx context.Context, channelID string) ([]*moderator, error) {
+	values, err := m.redisConn.HGetAll(ctx, moderatorsKey(channelID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	mods := make([]*moderator, 0, len(values))
+	for _, value := range values {
+		var mod moderator
+		if json.Unmarshal([]byte(value), &mod) == nil {
+			mods = append(mods, &mod)
+		}
+	}
+	sort.Slice(mods, func(i, j int) bool { return strings.ToLower(mods[i].Name) < strings.ToLower(mods[j].Name) })
+	return mods, nil
+}
+
+// Channels returns the channels userID moderates.
+func (m *moderatorList) Channels(ctx context.Context, userID string) ([]string, error) {
+	channels, err := m.redisConn.SMembers(ctx, moderatingKey(userID)).Result()
+	sort.Strings(channels)
+	return channels, err
+}
+
+// SyncTwitch makes the moderators that came from Twitch match the current
+// moderators of the channel, read with the broadcaster's access token. The
+// ones added by hand stay. It returns how many moderators Twitch has.
+func (m *moderatorList) SyncTwitch(ctx context.Context, channelID, accessToken string) (int, error) {
+	fromTwitch, err := m.fetchTwitch(ctx, channelID, accessToken)
+	if err != nil {
+		return 0, err
+	}
+	current, err := m.List(ctx, channelID)
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]bool, len(current))
+	for _, mod := range current {
+		known[mod.ID] = true
+		if _, ok := fromTwitch[mod.ID]; !ok && mod.Source == moderatorTwitch {
+			if err = m.Remove(ctx, channelID, mod.ID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for id, name := range fromTwitch {
+		if known[id] {
+			continue
+		}
+		mod := &moderator{ID: id, Name: name, Source: moderatorTwitch, AddedAt: time.Now()}
+		if err = m.Add(ctx, channelID, mod); err != nil {
+			return 0, err
+		}
+	}
+	return len(fromTwitch), nil
+}
+
+// fetchTwitch returns the names of the moderators of channelID by user ID,
+// from the Get Moderators endpoint, which helix lacks. The token needs the
+// moderation:read scope.
+// https://dev.twitch.tv/docs/api/reference#get-moderators
+func (m *moderatorList) fetchTwitch(ctx context.Context, channelID, accessToken string) (map[string]string, error) {
+	mods := make(map[string]string)
+	cursor := ""
+	for {
+		query := url.Values{"broadcaster_id": {channelID}, "first": {"100"}}
+		if cursor != "" {
+			query.Set("after", cursor)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.twitch.apiURL("/moderation/moderators?"+query.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Client-Id", m.twitch.clientID)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		resp, err := m.twitch.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Data []struct {
+				UserID   string `json:"user_id"`
+				UserName string `json:"user_name"`
+			} `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+			Message string `json:"message"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET /moderation/moderators: %s %s", resp.Status, page.Message)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, mod := range page.Data {
+			mods[mod.UserID] = mod.UserName
+		}
+		if cursor = page.Pagination.Cursor; cursor == "" || len(page.Data) == 0 {
+			return mods, nil
+		}
+	}
+}
+
+// SessionUserID is the Twitch user ID of whoever is logged in. The session
+// is only taken at its word once Twitch confirms the access token in it
+// belongs to that user.
+func (m *moderatorList) SessionUserID(r *http.Request) (string, bool) {
+	session, err := cookieStore.Get(r, oauthSessionName)
+	if err != nil {
+		return "", false
+	}
+	userID, _ := session.Values[userIDKey].(string)
+	token, _ := session.Values[oauthTokenKey].(*helix.AccessCredentials)
+	if userID == "" || token == nil {
+		return "", false
+	}
+	owner, err := m.tokenOwner(r.Context(), token.AccessToken)
+	if err != nil {
+		slog.Warn("validating session token", logUserID, userID, "error", err)
+		return "", false
+	}
+	if owner != userID {
+		slog.Warn("session token of another user", logUserID, userID, "owner_id", owner)
+		return "", false
+	}
+	return userID, true
+}
+
+// tokenOwner returns the user ID Twitch says accessToken belongs to.
+func (m *moderatorList) tokenOwner(ctx context.Context, accessToken string) (string, error) {
+	m.tokensMutex.Lock()
+	validated, found := m.tokens[accessToken]
+	m.tokensMutex.Unlock()
+	if found && time.Now().Before(validated.until) {
+		return validated.userID, nil
+	}
+
+	client, err := m.twitch.OAuth()
+	if err != nil {
+		return "", err
+	}
+	span := helixSpan(ctx, "ValidateToken")
+	valid, resp, err := client.ValidateToken(accessToken)
+	endSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+	if !valid || resp.Data.ClientID != m.twitch.clientID {
+		return "", errInvalidToken
+	}
+
+	now := time.Now()
+	m.tokensMutex.Lock()
+	defer m.tokensMutex.Unlock()
+	for token, validated := range m.tokens {
+		if now.After(validated.until) {
+			delete(m.tokens, token)
+		}
+	}
+	m.tokens[accessToken] = validatedToken{userID: resp.Data.UserID, until: now.Add(tokenValidationTTL)}
+	return resp.Data.UserID, nil
+}
+
+// User tells who is logged in and which channel they are managing. A
+// moderator is checked against the moderators of the channel on every
+// call, so removing them takes effect right away; errNotModerator means
+// they were removed. errChannelUnavailable means the channel was suspended
+// or is left out of the allowlist; operators get in anyway.
+func (m *moderatorList) User(r *http.Request) (dashboardUser, error) {
+	userID, ok := m.SessionUserID(r)
+	if !ok {
+		return dashboardUser{}, errNoSession
+	}
+	session, _ := cookieStore.Get(r, oauthSessionName)
+	user := dashboardUser{UserID: userID, ChannelID: userID, Role: roleBroadcaster, Operator: m.channels.IsOperator(userID)}
+	if channelID, _ := session.Values[channelIDKey].(string); channelID != "" && channelID != userID {
+		is, err := m.Is(r.Context(), channelID, userID)
+		if err != nil {
+			return dashboardUser{}, err
+		}
+		user.ChannelID, user.Role = channelID, roleModerator
+		if !is {
+			return user, errNotModerator
+		}
+	}
+	if user.Operator {
+		return user, nil
+	}
+	available, err := m.channels.Available(r.Context(), user.ChannelID)
+	if err != nil {
+		return dashboardUser{}, err
+	}
+	if !available {
+		return user, errChannelUnavailable
+	}
+	return user, nil
+}
+
+// HandleModerators adds and removes the moderators of the logged-in
+// channel, by login or by importing the channel's moderators from Twitch.
+func HandleModerators(moderators *moderatorList, profiles *profileCache, audit *auditLog, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permModerators)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	switch r.PostFormValue("action") {
+	case "remove":
+		id := r.PostFormValue("id")
+		if err := moderators.Remove(ctx, user.ChannelID, id); err != nil {
+			slog.Error("removing moderator", logChannelID, user.ChannelID, logUserID, user.UserID, "moderator_id", id, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		audit.Record(ctx, user.UserID, user.ChannelID, auditModeratorRemove, id, nil, nil)
+		slog.Info("moderator removed", logChannelID, user.ChannelID, logUserID, user.UserID, "moderator_id", id)
+	case "import":
+		session, _ := cookieStore.Get(r, oauthSessionName)
+		token, ok := session.Values[oauthTokenKey].(*helix.AccessCredentials)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		before, err := moderators.List(ctx, user.ChannelID)
+		if err != nil {
+			slog.Error("listing moderators", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n, err := moderators.SyncTwitch(ctx, user.ChannelID, token.AccessToken)
+		if err != nil {
+			slog.Warn("importing moderators from twitch", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+			addFlash(w, r, "Não deu para ler os moderadores da Twitch. Saia e entre de novo para autorizar o acesso.")
+			break
+		}
+		after, err := moderators.List(ctx, user.ChannelID)
+		if err != nil {
+			slog.Error("listing moderators", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+		}
+		audit.Record(ctx, user.UserID, user.ChannelID, auditModeratorsImport, "", before, after)
+		slog.Info("moderators imported from twitch", logChannelID, user.ChannelID, logUserID, user.UserID, "count", n)
+		addFlash(w, r, fmt.Sprintf("%d moderadores importados da Twitch.", n))
+	default:
+		login := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.PostFormValue("login")), "@"))
+		prof, err := profiles.ByLogin(ctx, login)
+		if err != nil || login == "" {
+			addFlash(w, r, fmt.Sprintf("Usuário %q não encontrado.", login))
+			break
+		}
+		if prof.ID == user.ChannelID {
+			break
+		}
+		mod := &moderator{ID: prof.ID, Name: prof.DisplayName, Source: moderatorManual, AddedAt: time.Now()}
+		if err = moderators.Add(ctx, user.ChannelID, mod); err != nil {
+			slog.Error("adding moderator", logChannelID, user.ChannelID, logUserID, user.UserID, "moderator_id", mod.ID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		audit.Record(ctx, user.UserID, user.ChannelID, auditModeratorAdd, mod.ID, nil, mod)
+		slog.Info("moderator added", logChannelID, user.ChannelID, logUserID, user.UserID, "moderator_id", mod.ID)
+		addFlash(w, r, mod.Name+" agora pode moderar o canal.")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleSwitchChannel picks the channel the dashboard manages: the user's
+// own or one they moderate.
+func HandleSwitchChannel(moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := moderators.SessionUserID(r)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	channelID := r.PostFormValue("channel_id")
+	if channelID != userID {
+		is, err := moderators.Is(r.Context(), channelID, userID)
+		if err != nil {
+			slog.Error("checking moderator", logChannelID, channelID, logUserID, userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !is {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	session, _ := cookieStore.Get(r, oauthSessionName)
+	session.Values[channelIDKey] = channelID
+	if err := session.Save(r, w); err != nil {
+		slog.Error("saving session", logChannelID, channelID, logUserID, userID, "error", err)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// playbackURLTTL is how long a signed /ttsPlay/ URL stays valid.
+const playbackURLTTL = time.Hour
+
+var (
+	// playbackSecret signs the /ttsPlay/ URLs handed to the overlays. main
+	// loads it with loadPlaybackSecret.
+	playbackSecret []byte
+
+	errPlaybackSignature = errors.New("invalid playback signature")
+	errPlaybackExpired   = errors.New("playback url expired")
+)
+
+// audioMeta describes an audio blob stored by the TTS worker.
+type audioMeta struct {
+	ChannelID   string
+	ContentType string
+	ETag        string
+	Size        int64
+	CreatedAt   time.Time
+}
+
+func loadPlaybackSecret() ([]byte, error) {
+	if secret := os.Getenv("PLAYBACK_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	// sem segredo configurado, as urls só valem até o próximo restart
+	slog.Warn("PLAYBACK_SECRET not set, using a random secret")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func playbackSignature(audioID, channelID string, expires int64) string {
+	mac := hmac.New(sha256.New, playbackSecret)
+	mac.Write([]byte(audioID + "\n" + channelID + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// playbackURL returns a signed URL for audioID, bound to channelID and
+// valid for playbackURLTTL.
+func playbackURL(audioID, channelID string) string {
+	expires := time.Now().Add(playbackURLTTL).Unix()
+	q := url.Values{}
+	q.Set("c", channelID)
+	q.Set("e", strconv.FormatInt(expires, 10))
+	q.Set("s", playbackSignature(audioID, channelID, expires))
+	return baseURL + "/ttsPlay/" + url.PathEscape(audioID) + "?" + q.Encode()
+}
+
+// verifyPlayback checks the signature of a /ttsPlay/ request and returns
+// the channel it is bound to and when it expires.
+func verifyPlayback(audioID string, q url.Values) (channelID string, expires time.Time, err error) {
+	channelID = q.Get("c")
+	exp, err := strconv.ParseInt(q.Get("e"), 10, 64)
+	if err != nil || channelID == "" {
+		return "", time.Time{}, errPlaybackSignature
+	}
+	expected := playbackSignature(audioID, channelID, exp)
+	if !hmac.Equal([]byte(expected), []byte(q.Get("s"))) {
+		return "", time.Time{}, errPlaybackSignature
+	}
+	expires = time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return "", time.Time{}, errPlaybackExpired
+	}
+	return channelID, expires, nil
+}
+
+func audioMetaKey(audioID string) string {
+	return audioID + ":meta"
+}
+
+// saveAudioMeta inspects the audio stored under audioID and records its
+// metadata next to it, with the same expiration.
+func saveAudioMeta(ctx context.Context, redisConn *redis.Client, audioID, channelID string) (*audioMeta, error) {
+	b, err := redisConn.Get(ctx, audioID).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	meta := newAudioMeta(channelID, b)
+	key := audioMetaKey(audioID)
+	if err = redisConn.HSet(ctx, key,
+		"channel_id", meta.ChannelID,
+		"content_type", meta.ContentType,
+		"etag", meta.ETag,
+		"size", meta.Size,
+		"created_at", meta.CreatedAt.Unix(),
+	).Err(); err != nil {
+		return nil, err
+	}
+	if ttl, err := redisConn.PTTL(ctx, audioID).Result(); err == nil && ttl > 0 {
+		redisConn.PExpire(ctx, key, ttl)
+	}
+	return meta, nil
+}
+
+// loadAudioMeta returns the metadata stored for audioID, or redis.Nil if
+// there is none.
+func loadAudioMeta(ctx context.Context, redisConn *redis.Client, audioID string) (*audioMeta, error) {
+	values, err := redisConn.HGetAll(ctx, audioMetaKey(audioID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, redis.Nil
+	}
+	size, _ := strconv.ParseInt(values["size"], 10, 64)
+	createdAt, _ := strconv.ParseInt(values["created_at"], 10, 64)
+	return &audioMeta{
+		ChannelID:   values["channel_id"],
+		ContentType: values["content_type"],
+		ETag:        values["etag"],
+		Size:        size,
+		CreatedAt:   time.Unix(createdAt, 0),
+	}, nil
+}
+
+func newAudioMeta(channelID string, b []byte) *audioMeta {
+	sum := sha256.Sum256(b)
+	return &audioMeta{
+		ChannelID:   channelID,
+		ContentType: audioContentType(b),
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		Size:        int64(len(b)),
+		CreatedAt:   time.Now(),
+	}
+}
+
+func audioContentType(b []byte) string {
+	switch contentType := http.DetectContentType(b); contentType {
+	case "audio/wave":
+		return "audio/wav"
+	case "application/ogg":
+		return "audio/ogg"
+	default:
+		return contentType
+	}
+}
+
+// audioFileName is the name advertised in Content-Disposition.
+func audioFileName(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	switch contentType {
+	case "audio/mpeg":
+		return "audio.mp3"
+	case "audio/ogg":
+		return "audio.ogg"
+	default:
+		return "audio.wav"
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPlayback(t *testing.T) {
+	playbackSecret = []byte("test secret")
+
+	signed, err := url.Parse(playbackURL("audio-1", "123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(signed.Path, "/ttsPlay/audio-1") {
+		t.Fatalf("playbackURL path = %q", signed.Path)
+	}
+	valid := signed.Query()
+
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range valid {
+			q[k] = v
+		}
+		q.Set(key, value)
+		return q
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	expired := url.Values{
+		"c": {"123"},
+		"e": {strconv.FormatInt(past, 10)},
+		"s": {playbackSignature("audio-1", "123", past)},
+	}
+
+	tests := []struct {
+		name    string
+		audioID string
+		query   url.Values
+		want    error
+	}{
+		{"valid", "audio-1", valid, nil},
+		{"tampered channel", "audio-1", with("c", "456"), errPlaybackSignature},
+		{"tampered audio id", "audio-2", valid, errPlaybackSignature},
+		{"tampered expiry", "audio-1", with("e", strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)), errPlaybackSignature},
+		{"tampered signature", "audio-1", with("s", strings.Repeat("0", 64)), errPlaybackSignature},
+		{"no channel", "audio-1", with("c", ""), errPlaybackSignature},
+		{"bad expiry", "audio-1", with("e", "amanhã"), errPlaybackSignature},
+		{"expired", "audio-1", expired, errPlaybackExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channelID, expires, err := verifyPlayback(tt.audioID, tt.query)
+			if err != tt.want {
+				t.Fatalf("verifyPlayback() error = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			if channelID != "123" {
+				t.Errorf("verifyPlayback() channel = %q, want %q", channelID, "123")
+			}
+			if until := time.Until(expires); until <= 0 || until > playbackURLTTL {
+				t.Errorf("verifyPlayback() expires in %v, want within %v", until, playbackURLTTL)
+			}
+		})
+	}
+}
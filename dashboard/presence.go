@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// presenceKeepAlive is how often the status stream sends something even
+// when nothing changed, so proxies don't drop it.
+const presenceKeepAlive = 25 * time.Second
+
+// clientStatus is what the dashboard shows of a connected overlay.
+type clientStatus struct {
+	Role         string     `json:"role"`
+	Version      int        `json:"version"`
+	Capabilities []string   `json:"capabilities"`
+	AudioFormat  string     `json:"audio_format"`
+	QueueLength  int        `json:"queue_length"`
+	ConnectedAt  time.Time  `json:"connected_at"`
+	LastPing     *time.Time `json:"last_ping"`
+}
+
+// Status reports the state of the overlay.
+func (c *Client) Status() clientStatus {
+	c.stateMutex.RLock()
+	defer c.stateMutex.RUnlock()
+	status := clientStatus{
+		Role:         c.role,
+		Version:      c.version,
+		Capabilities: make([]string, 0, len(c.capabilities)),
+		AudioFormat:  c.audioFormat,
+		QueueLength:  c.queueLength,
+		ConnectedAt:  c.connectedAt,
+	}
+	for capability := range c.capabilities {
+		status.Capabilities = append(status.Capabilities, capability)
+	}
+	sort.Strings(status.Capabilities)
+	if !c.lastPing.IsZero() {
+		lastPing := c.lastPing
+		status.LastPing = &lastPing
+	}
+	return status
+}
+
+// Presence returns the status of every client connected to channelID, the
+// oldest first.
+func (h *Hub) Presence(channelID string) []clientStatus {
+	clients := h.Clients(channelID)
+	presence := make([]clientStatus, 0, len(clients))
+	for _, client := range clients {
+		presence = append(presence, client.Status())
+	}
+	sort.Slice(presence, func(i, j int) bool { return presence[i].ConnectedAt.Before(presence[j].ConnectedAt) })
+	return presence
+}
+
+// Watch returns a channel that receives whenever the presence of channelID
+// changes, and the function to stop watching.
+func (h *Hub) Watch(channelID string) (<-chan struct{}, func()) {
+	changed := make(chan struct{}, 1)
+	h.watchMutex.Lock()
+	defer h.watchMutex.Unlock()
+	if h.watchers[channelID] == nil {
+		h.watchers[channelID] = make(map[chan struct{}]bool)
+	}
+	h.watchers[channelID][changed] = true
+	return changed, func() {
+		h.watchMutex.Lock()
+		defer h.watchMutex.Unlock()
+		delete(h.watchers[channelID], changed)
+		if len(h.watchers[channelID]) == 0 {
+			delete(h.watchers, channelID)
+		}
+	}
+}
+
+// changed wakes up the watchers of channelID without ever blocking: a
+// watcher that has a change pending already will look at the new state.
+func (h *Hub) changed(channelID string) {
+	h.watchMutex.Lock()
+	defer h.watchMutex.Unlock()
+	for watcher := range h.watchers[channelID] {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// HandleStatusEvents streams the overlays connected to the logged-in
+// channel as Server-Sent Events, one "presence" event per change.
+func HandleStatusEvents(hub *Hub, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardAccess(w, r, moderators, permStatus)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	changed, stop := hub.Watch(user.ChannelID)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	keepAlive := time.NewTicker(presenceKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		b, _ := json.Marshal(struct {
+			Overlays []clientStatus `json:"overlays"`
+		}{hub.Presence(user.ChannelID)})
+		if _, err := fmt.Fprintf(w, "event: presence\ndata: %s\n\n", b); err != nil {
+			slog.Debug("presence stream closed", logChannelID, user.ChannelID, "error", err)
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepAlive.C:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nicklaw5/helix"
+)
+
+// helixMaxUsers is how many users a single GetUsers call accepts.
+const helixMaxUsers = 100
+
+// anonymousName is shown for viewers we know nothing about.
+const anonymousName = "Anônimo"
+
+// profile is what overlay cards and the dashboard show of a Twitch user.
+type profile struct {
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+	Picture     string `json:"picture"`
+}
+
+// profileCache keeps Twitch user profiles in Redis for ttl, fetching the
+// missing ones from helix in batches.
+type profileCache struct {
+	redisConn *redis.Client
+	twitch    *twitchAPI
+	ttl       time.Duration
+}
+
+func newProfileCache(redisConn *redis.Client, twitch *twitchAPI, ttl time.Duration) *profileCache {
+	return &profileCache{redisConn: redisConn, twitch: twitch, ttl: ttl}
+}
+
+func profileKey(userID string) string {
+	return "profile:" + userID
+}
+
+// Get returns the profile of a single user.
+func (p *profileCache) Get(ctx context.Context, userID string) profile {
+	return p.Lookup(ctx, []string{userID})[userID]
+}
+
+// Lookup returns the profiles of userIDs. Every ID gets a profile: opaque
+// IDs, users that don't exist and failed lookups get an anonymous one.
+func (p *profileCache) Lookup(ctx context.Context, userIDs []string) map[string]profile {
+	profiles := make(map[string]profile, len(userIDs))
+	var missing []string
+
+	keys := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		if isOpaqueID(id) {
+			profiles[id] = anonymousProfile(id)
+			continue
+		}
+		keys = append(keys, profileKey(id))
+	}
+	if len(keys) > 0 {
+		cached, err := p.redisConn.MGet(ctx, keys...).Result()
+		if err != nil {
+			slog.Error("loading cached profiles", "error", err)
+			cached = make([]interface{}, len(keys))
+		}
+		for i, value := range cached {
+			id := keys[i][len(profileKey("")):]
+			var prof profile
+			if s, ok := value.(string); ok && json.Unmarshal([]byte(s), &prof) == nil {
+				profiles[id] = prof
+			} else {
+				missing = append(missing, id)
+			}
+		}
+	}
+
+	for start := 0; start < len(missing); start += helixMaxUsers {
+		end := start + helixMaxUsers
+		if end > len(missing) {
+			end = len(missing)
+		}
+		fetched, err := p.fetch(ctx, missing[start:end])
+		if err != nil {
+			slog.Error("fetching profiles", "error", err)
+		}
+		for id, prof := range fetched {
+			profiles[id] = prof
+		}
+	}
+
+	for _, id := range userIDs {
+		if _, ok := profiles[id]; !ok {
+			profiles[id] = anonymousProfile(id)
+		}
+	}
+	return profiles
+}
+
+// ByLogin returns the profile of the user whose login is login, asking
+// helix as logins are not cached.
+func (p *profileCache) ByLogin(ctx context.Context, login string) (profile, error) {
+	client, err := p.twitch.App()
+	if err != nil {
+		return profile{}, err
+	}
+	span := helixSpan(ctx, "GetUsers")
+	resp, err := client.GetUsers(&helix.UsersParams{Logins: []string{login}})
+	endSpan(span, err)
+	if err != nil {
+		return profile{}, err
+	}
+	if resp.Error != "" {
+		return profile{}, fmt.Errorf("GetUsers: %s", resp.ErrorMessage)
+	}
+	if len(resp.Data.Users) == 0 {
+		return profile{}, fmt.Errorf("no user %q", login)
+	}
+	return p.Get(ctx, resp.Data.Users[0].ID), nil
+}
+
+// fetch gets up to helixMaxUsers profiles from helix and caches them.
+func (p *profileCache) fetch(ctx context.Context, userIDs []string) (map[string]profile, error) {
+	client, err := p.twitch.App()
+	if err != nil {
+		return nil, err
+	}
+	span := helixSpan(ctx, "GetUsers")
+	resp, err := client.GetUsers(&helix.UsersParams{IDs: userIDs})
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("GetUsers: %s", resp.ErrorMessage)
+	}
+
+	profiles := make(map[string]profile, len(resp.Data.Users))
+	pipe := p.redisConn.Pipeline()
+	for _, user := range resp.Data.Users {
+		prof := profile{
+			ID:          user.ID,
+			Login:       user.Login,
+			DisplayName: user.DisplayName,
+			Picture:     user.ProfileImageURL,
+		}
+		profiles[user.ID] = prof
+		b, _ := json.Marshal(prof)
+		pipe.Set(ctx, profileKey(user.ID), b, p.ttl)
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		slog.Error("caching profiles", "error", err)
+	}
+	return profiles, nil
+}
+
+// isOpaqueID tells opaque extension IDs, "U" or "A" followed by letters and
+// digits (e.g. "UG12X345T6J78"), from Twitch user IDs, which are numeric.
+func isOpaqueID(id string) bool {
+	if id == "" {
+		return true
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return true
+		}
+	}
+	return false
+}
+
+func anonymousProfile(id string) profile {
+	return profile{ID: id, DisplayName: anonymousName}
+}
+
+var (
+	nicknameAnimals    = []string{"Capivara", "Jaguatirica", "Preguiça", "Arara", "Ariranha", "Lontra", "Coruja", "Raposa", "Girafa", "Onça", "Foca", "Lhama"}
+	nicknameAdjectives = []string{"Curiosa", "Tímida", "Falante", "Sonolenta", "Elegante", "Misteriosa", "Animada", "Valente", "Distraída", "Risonha"}
+)
+
+// nicknameProfile gives an anonymous viewer a stable, made up name derived
+// from their opaque ID.
+func nicknameProfile(opaqueID string) profile {
+	h := fnv.New32a()
+	h.Write([]byte(opaqueID))
+	sum := h.Sum32()
+	animal := nicknameAnimals[sum%uint32(len(nicknameAnimals))]
+	adjective := nicknameAdjectives[(sum/uint32(len(nicknameAnimals)))%uint32(len(nicknameAdjectives))]
+	return profile{
+		ID:          opaqueID,
+		DisplayName: fmt.Sprintf("%s %s #%02d", animal, adjective, sum%100),
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// protocolVersion is the overlay websocket protocol spoken by this server.
+// Overlays that never say hello speak version 0 and only ever receive bare
+// Messages.
+const protocolVersion = 1
+
+// Envelope types, in both directions.
+const (
+	typeHello      = "hello"
+	typeMessage    = "message"
+	typeSettings   = "settings"
+	typeAckPlayed  = "ack_played"
+	typeQueueState = "queue_state"
+	typeError      = "error"
+	typePing       = "ping"
+	typePong       = "pong"
+)
+
+// Envelope wraps everything exchanged with overlays from protocol version 1
+// on.
+type Envelope struct {
+	Type    string      `json:"type"`
+	Version int         `json:"version"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// inboundEnvelope is an Envelope read from an overlay, whose payload is
+// decoded according to its type.
+type inboundEnvelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// channelEnvelope is an envelope for the overlay of a channel.
+type channelEnvelope struct {
+	channelID string
+	envelope  *Envelope
+}
+
+// inboundMessage is an envelope waiting to be routed by the hub.
+type inboundMessage struct {
+	client   *Client
+	envelope *inboundEnvelope
+	err      error
+}
+
+type helloPayload struct {
+	Capabilities []string `json:"capabilities"`
+	AudioFormat  string   `json:"audio_format,omitempty"`
+
+	// Epoch and LastSeq of the last message seen: overlays send them when
+	// reconnecting to get what they missed; the server sends its current
+	// epoch.
+	Epoch   string  `json:"epoch,omitempty"`
+	LastSeq *uint64 `json:"last_seq,omitempty"`
+}
+
+type ackPlayedPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+type queueStatePayload struct {
+	Length int `json:"length"`
+}
+
+type errorPayload struct {
+	Message string `json:"message"`
+}
+
+type pingPayload struct {
+	Time int64 `json:"time"`
+}
+
+func newEnvelope(typ string, payload interface{}) *Envelope {
+	return &Envelope{Type: typ, Version: protocolVersion, Payload: payload}
+}
+
+func errorEnvelope(format string, a ...interface{}) *Envelope {
+	return newEnvelope(typeError, errorPayload{Message: fmt.Sprintf(format, a...)})
+}
+
+// decodeEnvelope parses a message read from an overlay. Version 0 overlays
+// sent their hello with the fields at the top level, so that one is
+// accepted as well.
+func decodeEnvelope(message []byte) (*inboundEnvelope, error) {
+	var envelope inboundEnvelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	if envelope.Type == "" {
+		return nil, fmt.Errorf("missing envelope type")
+	}
+	if envelope.Version > protocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d", envelope.Version)
+	}
+	if envelope.Version == 0 && envelope.Type == typeHello && envelope.Payload == nil {
+		envelope.Payload = message
+	}
+	return &envelope, nil
+}
+
+// route handles an envelope sent by an overlay, replying through the
+// client's send channel. It runs on the hub goroutine.
+func (h *Hub) route(in *inboundMessage) {
+	c := in.client
+	if in.err != nil {
+		slog.Warn("invalid envelope from overlay", logChannelID, c.id, "role", c.role, "error", in.err)
+		h.reply(c, errorEnvelope("%v", in.err))
+		return
+	}
+
+	envelope := in.envelope
+	switch envelope.Type {
+	case typeHello:
+		var hello helloPayload
+		if err := json.Unmarshal(envelope.Payload, &hello); err != nil {
+			h.reply(c, errorEnvelope("invalid %s payload: %v", envelope.Type, err))
+			return
+		}
+		c.hello(envelope.Version, &hello)
+		h.changed(c.id)
+		h.reply(c, newEnvelope(typeHello, helloPayload{
+			Capabilities: []string{capInlineAudio},
+			Epoch:        h.epoch,
+		}))
+		h.reply(c, newEnvelope(typeSettings, c.settings))
+		if hello.LastSeq != nil && envelope.Version > 0 {
+			h.replay(c, hello.Epoch, *hello.LastSeq)
+		}
+	case typeAckPlayed:
+		var ack ackPlayedPayload
+		if err := json.Unmarshal(envelope.Payload, &ack); err != nil || ack.MessageID == "" {
+			h.reply(c, errorEnvelope("invalid %s payload", envelope.Type))
+			return
+		}
+		// a mensagem já pode ter saído do backlog
+		var requestID string
+		if message := h.backlogs[c.id].find(ack.MessageID); message != nil {
+			requestID = message.RequestID
+			// fecha o trace da mensagem com o fim da reprodução
+			_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), message.spanContext), "overlay.played",
+				trace.WithAttributes(attribute.String("role", c.role)))
+			span.End()
+		}
+		slog.Info("message played", logRequestID, requestID, logChannelID, c.id,
+			logMessageID, ack.MessageID, "role", c.role)
+		if c.role == roleOverlay {
+			go h.history.SetOutcome(context.Background(), c.id, ack.MessageID, outcomePlayed)
+		}
+	case typeQueueState:
+		var state queueStatePayload
+		if err := json.Unmarshal(envelope.Payload, &state); err != nil || state.Length < 0 {
+			h.reply(c, errorEnvelope("invalid %s payload", envelope.Type))
+			return
+		}
+		c.setQueueLength(state.Length)
+		h.changed(c.id)
+	case typePing:
+		c.ping()
+		h.changed(c.id)
+		h.reply(c, newEnvelope(typePong, pingPayload{Time: time.Now().UnixNano() / int64(time.Millisecond)}))
+	case typeError:
+		var e errorPayload
+		_ = json.Unmarshal(envelope.Payload, &e)
+		slog.Warn("overlay reported an error", logChannelID, c.id, "role", c.role, "error", e.Message)
+	default:
+		h.reply(c, errorEnvelope("unknown envelope type %q", envelope.Type))
+	}
+}
+
+// reply queues envelope to c without blocking the hub.
+func (h *Hub) reply(c *Client, envelope *Envelope) {
+	if !h.clients[c.id][c] {
+		// already unregistered, send is closed
+		return
+	}
+	select {
+	case c.send <- envelope:
+	default:
+		slog.Warn("send buffer full, dropping envelope", logChannelID, c.id, "role", c.role, "type", envelope.Type)
+	}
+}
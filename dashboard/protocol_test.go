@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestDecodeEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		wantErr  bool
+		wantType string
+		// payload expected, when it isn't the one in the message
+		wantPayload string
+	}{
+		{name: "hello", message: `{"type":"hello","version":1,"payload":{"capabilities":["inline_audio"]}}`, wantType: typeHello},
+		{name: "ack", message: `{"type":"ack_played","version":1,"payload":{"message_id":"m1"}}`, wantType: typeAckPlayed},
+		{name: "unknown type is left to route", message: `{"type":"dance","version":1}`, wantType: "dance"},
+		{name: "version 0 hello", message: `{"type":"hello","capabilities":["inline_audio"]}`, wantType: typeHello,
+			wantPayload: `{"type":"hello","capabilities":["inline_audio"]}`},
+		{name: "missing type", message: `{"version":1,"payload":{}}`, wantErr: true},
+		{name: "newer version", message: `{"type":"hello","version":2}`, wantErr: true},
+		{name: "bad json", message: `{"type":"hello"`, wantErr: true},
+		{name: "not an object", message: `["hello"]`, wantErr: true},
+		{name: "wrong field type", message: `{"type":"hello","version":"1"}`, wantErr: true},
+		{name: "empty", message: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := decodeEnvelope([]byte(tt.message))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeEnvelope() = %+v, want an error", envelope)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeEnvelope() error = %v", err)
+			}
+			if envelope.Type != tt.wantType {
+				t.Errorf("decodeEnvelope() type = %q, want %q", envelope.Type, tt.wantType)
+			}
+			if tt.wantPayload != "" && string(envelope.Payload) != tt.wantPayload {
+				t.Errorf("decodeEnvelope() payload = %s, want %s", envelope.Payload, tt.wantPayload)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	// o container pode não ter o banco de fusos horários
+	_ "time/tzdata"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Periods and resources a quota limits.
+const (
+	quotaDay        = "day"
+	quotaMonth      = "month"
+	quotaRequests   = "requests"
+	quotaCharacters = "characters"
+)
+
+// quotaLocation is where days and months start and end. main loads it
+// with loadQuotaLocation.
+var quotaLocation = time.UTC
+
+func loadQuotaLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("unknown quota timezone, using UTC", "timezone", name, "error", err)
+		return time.UTC
+	}
+	return location
+}
+
+// quotaLimits are how many messages and characters a channel may send to
+// the TTS per day and per month; zero means no limit.
+type quotaLimits struct {
+	DailyRequests     int64 `json:"daily_requests"`
+	DailyCharacters   int64 `json:"daily_characters"`
+	MonthlyRequests   int64 `json:"monthly_requests"`
+	MonthlyCharacters int64 `json:"monthly_characters"`
+}
+
+// quotaUsage is how much a channel used the TTS in a period.
+type quotaUsage struct {
+	Requests   int64
+	Characters int64
+}
+
+// quotaStatus is the usage of a channel against its limits.
+type quotaStatus struct {
+	Limits quotaLimits
+	// Custom tells whether the operators set the limits of this channel,
+	// instead of the defaults.
+	Custom bool
+	Day    quotaUsage
+	Month  quotaUsage
+	// Total is the usage since the channel registered.
+	Total quotaUsage
+	// LastMessageAt is when the channel last got a message, if ever.
+	LastMessageAt *time.Time
+}
+
+// Percent tells how much of limit used is, capped at 100, to draw progress
+// bars.
+func (quotaStatus) Percent(used, limit int64) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	if used >= limit {
+		return 100
+	}
+	return used * 100 / limit
+}
+
+// quotaExceeded tells which quota a message would exceed, and when it
+// resets.
+type quotaExceeded struct {
+	Period   string
+	Resource string
+	ResetAt  time.Time
+}
+
+// Message explains the viewer why their message wasn't sent.
+func (e *quotaExceeded) Message() string {
+	period := "diário"
+	if e.Period == quotaMonth {
+		period = "mensal"
+	}
+	resource := "mensagens"
+	if e.Resource == quotaCharacters {
+		resource = "caracteres"
+	}
+	return fmt.Sprintf("Este canal atingiu o limite %s de %s do TTS. Tente de novo a partir de %s.",
+		period, resource, e.ResetAt.In(quotaLocation).Format("02/01 15:04"))
+}
+
+// quotaTracker counts the TTS usage of each channel per day, per month and
+// since it registered in Redis, and enforces the limits of QUOTA_DAILY_* and QUOTA_MONTHLY_*, which
+// the operators can override per channel.
+type quotaTracker struct {
+	redisConn *redis.Client
+	defaults  quotaLimits
+}
+
+func newQuotaTracker(redisConn *redis.Client) *quotaTracker {
+	return &quotaTracker{
+		redisConn: redisConn,
+		defaults: quotaLimits{
+			DailyRequests:     int64(envInt("QUOTA_DAILY_REQUESTS", 0)),
+			DailyCharacters:   int64(envInt("QUOTA_DAILY_CHARACTERS", 0)),
+			MonthlyRequests:   int64(envInt("QUOTA_MONTHLY_REQUESTS", 0)),
+			MonthlyCharacters: int64(envInt("QUOTA_MONTHLY_CHARACTERS", 0)),
+		},
+	}
+}
+
+func quotaLimitsKey(channelID string) string {
+	return "quota-limits:" + channelID
+}
+
+func quotaDayKey(channelID string, t time.Time) string {
+	return "quota:" + channelID + ":day:" + t.In(quotaLocation).Format("2006-01-02")
+}
+
+func quotaMonthKey(channelID string, t time.Time) string {
+	return "quota:" + channelID + ":month:" + t.In(quotaLocation).Format("2006-01")
+}
+
+// usageKey holds the usage of channelID since it registered, and when it
+// last got a message.
+func usageKey(channelID string) string {
+	return "usage:" + channelID
+}
+
+// quotaResets returns when the day and the month of t end.
+func quotaResets(t time.Time) (day, month time.Time) {
+	t = t.In(quotaLocation)
+	day = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, quotaLocation)
+	month = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, quotaLocation)
+	return day, month
+}
+
+// Limits returns the limits of channelID, and whether they were set by the
+// operators.
+func (q *quotaTracker) Limits(ctx context.Context, channelID string) (quotaLimits, bool, error) {
+	b, err := q.redisConn.Get(ctx, quotaLimitsKey(channelID)).Bytes()
+	if err == redis.Nil {
+		return q.defaults, false, nil
+	}
+	if err != nil {
+		return q.defaults, false, err
+	}
+	var limits quotaLimits
+	if err = json.Unmarshal(b, &limits); err != nil {
+		return q.defaults, false, err
+	}
+	return limits, true, nil
+}
+
+// SetLimits overrides the limits of channelID; nil goes back to the
+// defaults.
+func (q *quotaTracker) SetLimits(ctx context.Context, channelID string, limits *quotaLimits) error {
+	if limits == nil {
+		return q.redisConn.Del(ctx, quotaLimitsKey(channelID)).Err()
+	}
+	b, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	return q.redisConn.Set(ctx, quotaLimitsKey(channelID), b, 0).Err()
+}
+
+func parseQuotaUsage(values map[string]string) quotaUsage {
+	var usage quotaUsage
+	usage.Requests, _ = strconv.ParseInt(values[quotaRequests], 10, 64)
+	usage.Characters, _ = strconv.ParseInt(values[quotaCharacters], 10, 64)
+	return usage
+}
+
+// Status returns the usage of channelID in the current day and month, and
+// since it registered.
+func (q *quotaTracker) Status(ctx context.Context, channelID string) (quotaStatus, error) {
+	var status quotaStatus
+	var err error
+	if status.Limits, status.Custom, err = q.Limits(ctx, channelID); err != nil {
+		return status, err
+	}
+	now := time.Now()
+	pipe := q.redisConn.Pipeline()
+	day := pipe.HGetAll(ctx, quotaDayKey(channelID, now))
+	month := pipe.HGetAll(ctx, quotaMonthKey(channelID, now))
+	total := pipe.HGetAll(ctx, usageKey(channelID))
+	if _, err = pipe.Exec(ctx); err != nil {
+		return status, err
+	}
+	status.Day = parseQuotaUsage(day.Val())
+	status.Month = parseQuotaUsage(month.Val())
+	status.Total.Requests, _ = strconv.ParseInt(total.Val()["messages"], 10, 64)
+	status.Total.Characters, _ = strconv.ParseInt(total.Val()["characters"], 10, 64)
+	if unix, err := strconv.ParseInt(total.Val()["last_message_at"], 10, 64); err == nil {
+		at := time.Unix(unix, 0)
+		status.LastMessageAt = &at
+	}
+	return status, nil
+}
+
+// Check tells whether a message of characters characters would exceed a
+// quota of channelID, returning which one. Usage is only counted by Add,
+// once the audio was generated, so concurrent messages may overshoot a
+// limit by a few.
+func (q *quotaTracker) Check(ctx context.Context, channelID string, characters int) (*quotaExceeded, error) {
+	status, err := q.Status(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	dayReset, monthReset := quotaResets(time.Now())
+	checks := []struct {
+		period, resource string
+		used, limit      int64
+		reset            time.Time
+	}{
+		{quotaMonth, quotaRequests, status.Month.Requests + 1, status.Limits.MonthlyRequests, monthReset},
+		{quotaMonth, quotaCharacters, status.Month.Characters + int64(characters), status.Limits.MonthlyCharacters, monthReset},
+		{quotaDay, quotaRequests, status.Day.Requests + 1, status.Limits.DailyRequests, dayReset},
+		{quotaDay, quotaCharacters, status.Day.Characters + int64(characters), status.Limits.DailyCharacters, dayReset},
+	}
+	for _, check := range checks {
+		if check.limit > 0 && check.used > check.limit {
+			return &quotaExceeded{Period: check.period, Resource: check.resource, ResetAt: check.reset}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Add counts a message of characters characters sent to channelID, and
+// when it was sent. Daily counters are kept for a couple of days, monthly
+// ones for a year, so the operators can look back when planning costs, and
+// the totals forever.
+func (q *quotaTracker) Add(ctx context.Context, channelID string, characters int) {
+	now := time.Now()
+	day, month := quotaDayKey(channelID, now), quotaMonthKey(channelID, now)
+	pipe := q.redisConn.TxPipeline()
+	pipe.HIncrBy(ctx, day, quotaRequests, 1)
+	pipe.HIncrBy(ctx, day, quotaCharacters, int64(characters))
+	pipe.Expire(ctx, day, 48*time.Hour)
+	pipe.HIncrBy(ctx, month, quotaRequests, 1)
+	pipe.HIncrBy(ctx, month, quotaCharacters, int64(characters))
+	pipe.Expire(ctx, month, 366*24*time.Hour)
+	pipe.HIncrBy(ctx, usageKey(channelID), "messages", 1)
+	pipe.HIncrBy(ctx, usageKey(channelID), "characters", int64(characters))
+	pipe.HSet(ctx, usageKey(channelID), "last_message_at", now.Unix())
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("counting quota usage", logChannelID, channelID, "error", err)
+	}
+}
+
+// quotaLimitsFromForm reads the limits of the admin page; blank or invalid
+// fields mean no limit.
+func quotaLimitsFromForm(r *http.Request) *quotaLimits {
+	field := func(name string) int64 {
+		n, err := strconv.ParseInt(r.PostFormValue(name), 10, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	return &quotaLimits{
+		DailyRequests:     field("daily_requests"),
+		DailyCharacters:   field("daily_characters"),
+		MonthlyRequests:   field("monthly_requests"),
+		MonthlyCharacters: field("monthly_characters"),
+	}
+}
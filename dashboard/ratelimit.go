@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ttsCooldown is how long a viewer waits between two messages on the same
+// channel.
+var ttsCooldown = envDuration("TTS_COOLDOWN", 10*time.Second)
+
+// allowViewer tells whether viewerID may send a message to channelID now,
+// starting its cooldown if so. viewerID is the Twitch user ID, or the opaque
+// ID of viewers who haven't shared their identity. When it says no, it also
+// returns how long until the viewer may try again.
+func allowViewer(ctx context.Context, redisConn *redis.Client, channelID, viewerID string, cooldown time.Duration) (bool, time.Duration, error) {
+	if cooldown <= 0 {
+		return true, 0, nil
+	}
+	key := cooldownKey(channelID, viewerID)
+	ok, err := redisConn.SetNX(ctx, key, 1, cooldown).Result()
+	if err != nil || ok {
+		return true, 0, err
+	}
+	ttl, err := redisConn.PTTL(ctx, key).Result()
+	return false, ttl, err
+}
+
+// releaseViewer ends the cooldown of viewerID, for messages that weren't
+// sent after all.
+func releaseViewer(ctx context.Context, redisConn *redis.Client, channelID, viewerID string) error {
+	return redisConn.Del(ctx, cooldownKey(channelID, viewerID)).Err()
+}
+
+func cooldownKey(channelID, viewerID string) string {
+	return "cooldown:" + channelID + ":" + viewerID
+}
@@ -0,0 +1,71 @@
+package main
+
+import "time"
+
+// How much of each channel's history is kept for overlays that reconnect.
+var (
+	replayMaxCount = envInt("REPLAY_MAX_COUNT", 50)
+	replayMaxAge   = envDuration("REPLAY_MAX_AGE", 10*time.Minute)
+)
+
+// backlog is a bounded, per-channel record of broadcast messages, kept
+// without their inline audio. It is only touched by the hub goroutine; a nil
+// backlog is empty.
+type backlog struct {
+	entries []backlogEntry
+}
+
+type backlogEntry struct {
+	at      time.Time
+	message *Message
+}
+
+// add records a copy of message, without the audio sent inline.
+func (b *backlog) add(message *Message) {
+	stored := *message
+	stored.AudioData, stored.AudioType, stored.inlineAudio = nil, "", nil
+	b.entries = append(b.entries, backlogEntry{at: time.Now(), message: &stored})
+	b.prune()
+}
+
+// since returns the messages recorded after seq, oldest first.
+func (b *backlog) since(seq uint64) (messages []*Message) {
+	if b == nil {
+		return nil
+	}
+	b.prune()
+	for _, entry := range b.entries {
+		if entry.message.Seq > seq {
+			messages = append(messages, entry.message)
+		}
+	}
+	return
+}
+
+// find returns the recorded message with id, or nil.
+func (b *backlog) find(id string) *Message {
+	if b == nil {
+		return nil
+	}
+	for _, entry := range b.entries {
+		if entry.message.ID == id {
+			return entry.message
+		}
+	}
+	return nil
+}
+
+func (b *backlog) prune() {
+	cutoff := time.Now().Add(-replayMaxAge)
+	drop := 0
+	for drop < len(b.entries) && (b.entries[drop].at.Before(cutoff) || len(b.entries)-drop > replayMaxCount) {
+		drop++
+	}
+	b.entries = b.entries[drop:]
+}
+
+// empty tells whether nothing recorded is left to replay.
+func (b *backlog) empty() bool {
+	b.prune()
+	return len(b.entries) == 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// withReplayLimits sets the backlog limits for the rest of the test.
+func withReplayLimits(t *testing.T, count int, age time.Duration) {
+	oldCount, oldAge := replayMaxCount, replayMaxAge
+	replayMaxCount, replayMaxAge = count, age
+	t.Cleanup(func() { replayMaxCount, replayMaxAge = oldCount, oldAge })
+}
+
+// seqs returns the seq of each message.
+func seqs(messages []*Message) []uint64 {
+	s := make([]uint64, 0, len(messages))
+	for _, m := range messages {
+		s = append(s, m.Seq)
+	}
+	return s
+}
+
+func TestBacklogSince(t *testing.T) {
+	withReplayLimits(t, 3, time.Hour)
+	b := &backlog{}
+	for seq := uint64(1); seq <= 5; seq++ {
+		b.add(&Message{ID: fmt.Sprint("m", seq), Seq: seq, AudioData: []byte("audio"), AudioType: "audio/wav"})
+	}
+
+	tests := []struct {
+		name string
+		seq  uint64
+		want []uint64
+	}{
+		{"everything", 0, []uint64{3, 4, 5}},
+		{"seq dropped by capacity", 1, []uint64{3, 4, 5}},
+		{"seq in the backlog", 3, []uint64{4, 5}},
+		{"last seq", 5, []uint64{}},
+		{"seq never sent", 42, []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := seqs(b.since(tt.seq)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("since(%d) = %v, want %v", tt.seq, got, tt.want)
+			}
+		})
+	}
+	for _, m := range b.since(0) {
+		if m.AudioData != nil || m.AudioType != "" {
+			t.Errorf("message %d kept its inline audio", m.Seq)
+		}
+	}
+}
+
+func TestBacklogAge(t *testing.T) {
+	withReplayLimits(t, 50, time.Minute)
+	b := &backlog{}
+	b.add(&Message{ID: "old", Seq: 1})
+	b.add(&Message{ID: "new", Seq: 2})
+	b.entries[0].at = time.Now().Add(-2 * time.Minute)
+
+	if got := seqs(b.since(0)); fmt.Sprint(got) != "[2]" {
+		t.Errorf("since(0) = %v, want [2]", got)
+	}
+	if b.find("old") != nil {
+		t.Error("find(old) found a message older than replayMaxAge")
+	}
+	// agora a mensagem nova também envelheceu
+	b.entries[0].at = time.Now().Add(-2 * time.Minute)
+	if !b.empty() {
+		t.Error("empty() = false with only old messages")
+	}
+}
+
+func TestBacklogFind(t *testing.T) {
+	withReplayLimits(t, 50, time.Hour)
+	b := &backlog{}
+	b.add(&Message{ID: "m1", Seq: 1})
+
+	if m := b.find("m1"); m == nil || m.Seq != 1 {
+		t.Errorf("find(m1) = %+v", m)
+	}
+	if m := b.find("unknown"); m != nil {
+		t.Errorf("find(unknown) = %+v, want nil", m)
+	}
+
+	var missing *backlog
+	if m := missing.find("m1"); m != nil {
+		t.Errorf("nil backlog find(m1) = %+v, want nil", m)
+	}
+	if got := missing.since(0); got != nil {
+		t.Errorf("nil backlog since(0) = %v, want nil", got)
+	}
+}
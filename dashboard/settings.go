@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// What to do with viewers who haven't shared their identity with the
+// extension, and so only have an opaque ID.
+const (
+	anonymousReject   = "reject"
+	anonymousAllow    = "anonymous"
+	anonymousNickname = "nickname"
+)
+
+// Card themes of the overlay.
+const (
+	themePurple = "roxo"
+	themeDark   = "escuro"
+	themeLight  = "claro"
+)
+
+var (
+	// availableVoices are the voices the TTS worker speaks with; the first
+	// one is the default.
+	availableVoices = strings.Split(envString("TTS_VOICES", "perola"), ",")
+
+	anonymousPolicies = []string{anonymousAllow, anonymousNickname, anonymousReject}
+	themes            = []string{themePurple, themeDark, themeLight}
+)
+
+const (
+	minMaxLength = 10
+	maxMaxLength = 500
+	maxCooldown  = time.Hour
+	maxFilters   = 200
+	maxHistory   = 365
+)
+
+// channelSettings is how a channel wants TTS to behave.
+type channelSettings struct {
+	Enabled         bool     `json:"enabled"`
+	Voices          []string `json:"voices"`
+	MaxLength       int      `json:"max_length"`
+	CooldownSeconds int      `json:"cooldown_seconds"`
+	Filters         []string `json:"filters"`
+	ApprovalMode    bool     `json:"approval_mode"`
+	Theme           string   `json:"theme"`
+	AnonymousPolicy string   `json:"anonymous_policy"`
+	HistoryDays     int      `json:"history_days"`
+}
+
+// overlaySettings is the part of the settings overlays care about.
+type overlaySettings struct {
+	Enabled bool   `json:"enabled"`
+	Theme   string `json:"theme"`
+}
+
+func defaultSettings() *channelSettings {
+	return &channelSettings{
+		Enabled:         true,
+		Voices:          []string{availableVoices[0]},
+		MaxLength:       200,
+		CooldownSeconds: int(ttsCooldown.Seconds()),
+		Theme:           themePurple,
+		AnonymousPolicy: envString("ANONYMOUS_POLICY", anonymousAllow),
+		HistoryDays:     envInt("HISTORY_RETENTION_DAYS", 30),
+	}
+}
+
+func settingsKey(channelID string) string {
+	return "settings:" + channelID
+}
+
+// loadSettings returns the settings of channelID, or the defaults when it
+// has none.
+func loadSettings(ctx context.Context, redisConn *redis.Client, channelID string) (*channelSettings, error) {
+	settings := defaultSettings()
+	b, err := redisConn.Get(ctx, settingsKey(channelID)).Bytes()
+	if err == redis.Nil {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err = json.Unmarshal(b, settings); err != nil {
+		return defaultSettings(), err
+	}
+	return settings, nil
+}
+
+func saveSettings(ctx context.Context, redisConn *redis.Client, channelID string, settings *channelSettings) error {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return redisConn.Set(ctx, settingsKey(channelID), b, 0).Err()
+}
+
+// settingsFromForm reads the settings form of the dashboard.
+func settingsFromForm(r *http.Request) (*channelSettings, error) {
+	settings := &channelSettings{
+		Enabled:         r.PostFormValue("enabled") == "on",
+		Voices:          r.PostForm["voices"],
+		ApprovalMode:    r.PostFormValue("approval_mode") == "on",
+		Theme:           r.PostFormValue("theme"),
+		AnonymousPolicy: r.PostFormValue("anonymous_policy"),
+	}
+	var err error
+	if settings.MaxLength, err = strconv.Atoi(r.PostFormValue("max_length")); err != nil {
+		return nil, fmt.Errorf("tamanho máximo inválido")
+	}
+	if settings.CooldownSeconds, err = strconv.Atoi(r.PostFormValue("cooldown_seconds")); err != nil {
+		return nil, fmt.Errorf("intervalo inválido")
+	}
+	if settings.HistoryDays, err = strconv.Atoi(r.PostFormValue("history_days")); err != nil {
+		return nil, fmt.Errorf("retenção do histórico inválida")
+	}
+	settings.Filters = filtersFromForm(r)
+	return settings, settings.validate()
+}
+
+// filtersFromForm reads the filtered words of the settings form, one per
+// line.
+func filtersFromForm(r *http.Request) []string {
+	var filters []string
+	for _, line := range strings.Split(r.PostFormValue("filters"), "\n") {
+		if word := strings.TrimSpace(line); word != "" {
+			filters = append(filters, word)
+		}
+	}
+	return filters
+}
+
+func (s *channelSettings) validate() error {
+	if len(s.Voices) == 0 {
+		return fmt.Errorf("escolha ao menos uma voz")
+	}
+	for _, voice := range s.Voices {
+		if !contains(availableVoices, voice) {
+			return fmt.Errorf("voz desconhecida: %q", voice)
+		}
+	}
+	if s.MaxLength < minMaxLength || s.MaxLength > maxMaxLength {
+		return fmt.Errorf("o tamanho máximo deve ficar entre %d e %d", minMaxLength, maxMaxLength)
+	}
+	if s.CooldownSeconds < 0 || s.CooldownSeconds > int(maxCooldown.Seconds()) {
+		return fmt.Errorf("o intervalo deve ficar entre 0 e %d segundos", int(maxCooldown.Seconds()))
+	}
+	if s.HistoryDays < 1 || s.HistoryDays > maxHistory {
+		return fmt.Errorf("o histórico deve ser guardado entre 1 e %d dias", maxHistory)
+	}
+	if len(s.Filters) > maxFilters {
+		return fmt.Errorf("no máximo %d palavras filtradas", maxFilters)
+	}
+	if !contains(themes, s.Theme) {
+		return fmt.Errorf("tema desconhecido: %q", s.Theme)
+	}
+	if !contains(anonymousPolicies, s.AnonymousPolicy) {
+		return fmt.Errorf("política de anônimos desconhecida: %q", s.AnonymousPolicy)
+	}
+	return nil
+}
+
+// Cooldown is how long each viewer waits between messages.
+func (s *channelSettings) Cooldown() time.Duration {
+	return time.Duration(s.CooldownSeconds) * time.Second
+}
+
+// HistoryRetention is how long messages stay in the history.
+func (s *channelSettings) HistoryRetention() time.Duration {
+	return time.Duration(s.HistoryDays) * 24 * time.Hour
+}
+
+// Voice picks the voice for a message: the one the viewer asked for, when
+// the channel enabled it, or the channel's first voice.
+func (s *channelSettings) Voice(requested string) string {
+	if contains(s.Voices, requested) {
+		return requested
+	}
+	if len(s.Voices) > 0 {
+		return s.Voices[0]
+	}
+	return availableVoices[0]
+}
+
+// Filtered returns the filtered word text contains, if any.
+func (s *channelSettings) Filtered(text string) (string, bool) {
+	lower := strings.ToLower(text)
+	for _, word := range s.Filters {
+		if strings.Contains(lower, strings.ToLower(word)) {
+			return word, true
+		}
+	}
+	return "", false
+}
+
+func (s *channelSettings) Overlay() overlaySettings {
+	return overlaySettings{Enabled: s.Enabled, Theme: s.Theme}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
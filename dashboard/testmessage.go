@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	testMessageText = "Olá! Esta é uma mensagem de teste do Vox. Se você está me ouvindo, está tudo certo."
+	testMessageUser = "Vox @ Twitch"
+
+	// testTTSTimeout is how long the test waits for the TTS worker before
+	// falling back to cannedAudio.
+	testTTSTimeout = 10 * time.Second
+)
+
+// cannedAudio is a short chime played by test messages when the TTS worker
+// is not answering, so the streamer can still check the overlay plays audio.
+var cannedAudio = chime(22050, []float64{659.25, 880}, 300*time.Millisecond)
+
+// chime renders notes, one after the other, as a 16-bit mono WAV.
+func chime(sampleRate int, notes []float64, noteLength time.Duration) []byte {
+	perNote := int(noteLength.Seconds() * float64(sampleRate))
+	samples := make([]int16, 0, perNote*len(notes))
+	for _, freq := range notes {
+		for i := 0; i < perNote; i++ {
+			t := float64(i) / float64(sampleRate)
+			decay := math.Exp(-4 * float64(i) / float64(perNote))
+			samples = append(samples, int16(0.5*math.MaxInt16*decay*math.Sin(2*math.Pi*freq*t)))
+		}
+	}
+
+	dataSize := uint32(len(samples) * 2)
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, 36+dataSize)
+	b.WriteString("WAVEfmt ")
+	_ = binary.Write(&b, binary.LittleEndian, struct {
+		ChunkSize     uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{16, 1, 1, uint32(sampleRate), uint32(sampleRate * 2), 2, 16})
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, dataSize)
+	_ = binary.Write(&b, binary.LittleEndian, samples)
+	return b.Bytes()
+}
+
+// storeCannedAudio stores cannedAudio like the TTS worker stores its audios
+// and returns its ID.
+func storeCannedAudio(ctx context.Context, redisConn *redis.Client) (string, error) {
+	audioID := "canned-" + uuid.New().String()
+	return audioID, redisConn.Set(ctx, audioID, cannedAudio, playbackURLTTL).Err()
+}
+
+// testTTS synthesizes text through c, giving up after testTTSTimeout.
+func testTTS(ctx context.Context, c *Client, text, voice string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, testTTSTimeout)
+	defer cancel()
+	return c.TestTTS(ctx, uuid.New().String(), text, voice)
+}
+
+// sendTestMessage synthesizes the test message through c, or falls back to
+// cannedAudio, and delivers it to the overlays of channelID.
+func sendTestMessage(ctx context.Context, hub *Hub, redisConn *redis.Client, c *Client, channelID, voice string) {
+	audioID, err := testTTS(ctx, c, testMessageText, voice)
+	if err != nil || audioID == "" {
+		slog.Warn("tts unavailable for the test message, using canned audio", logChannelID, channelID, "error", err)
+		if audioID, err = storeCannedAudio(ctx, redisConn); err != nil {
+			slog.Error("storing canned audio", logChannelID, channelID, "error", err)
+			return
+		}
+	}
+	if _, err = saveAudioMeta(ctx, redisConn, audioID, channelID); err != nil {
+		slog.Error("saving audio metadata", logChannelID, channelID, "audio_id", audioID, "error", err)
+	}
+
+	deliver(ctx, hub, redisConn, &Message{
+		ID:       uuid.New().String(),
+		AudioID:  audioID,
+		ClientID: channelID,
+		Text:     testMessageText,
+		UserName: testMessageUser,
+	})
+}
+
+// HandleTestMessage sends a sample message to the overlays of the logged-in
+// channel, preview included, so the streamer can check everything works
+// without asking a viewer. The message is synthesized in the background, so
+// the dashboard doesn't wait for the TTS worker.
+func HandleTestMessage(hub *Hub, redisConn *redis.Client, audit *auditLog, moderators *moderatorList, w http.ResponseWriter, r *http.Request) {
+	user, ok := dashboardPost(w, r, moderators, permSettings)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	clients := hub.Clients(user.ChannelID)
+	if len(clients) == 0 {
+		addFlash(w, r, "Nenhum overlay conectado: abra a fonte do navegador no OBS ou espere o preview conectar.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	c, found := hub.Overlay(user.ChannelID)
+	if !found {
+		c = clients[0]
+	}
+
+	settings, err := loadSettings(ctx, redisConn, user.ChannelID)
+	if err != nil {
+		slog.Error("loading settings", logChannelID, user.ChannelID, logUserID, user.UserID, "error", err)
+	}
+	// continua depois da resposta, mas com o trace do pedido
+	go sendTestMessage(context.WithoutCancel(ctx), hub, redisConn, c, user.ChannelID, settings.Voice(""))
+	audit.Record(ctx, user.UserID, user.ChannelID, auditTestMessage, "", nil, nil)
+	addFlash(w, r, "Mensagem de teste a caminho. Se o TTS não responder, o overlay toca um som de teste no lugar da voz.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
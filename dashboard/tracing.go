@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the dashboard. Until setupTracing runs, and
+// when it exports nowhere, spans cost next to nothing and go nowhere.
+var tracer = otel.Tracer("github.com/moniquelive/vox-twitch/dashboard")
+
+// setupTracing exports spans over OTLP/HTTP when the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is
+// set, e.g. http://localhost:4318 for a local collector. Trace context is
+// propagated as W3C traceparent, in HTTP and AMQP headers alike. The
+// returned function flushes the spans not exported yet.
+func setupTracing(ctx context.Context) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	noop := func(context.Context) error { return nil }
+	if envString("OTEL_EXPORTER_OTLP_ENDPOINT", "") == "" && envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") == "" {
+		return noop
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		slog.Error("creating trace exporter", "error", err)
+		return noop
+	}
+	// OTEL_SERVICE_NAME e OTEL_RESOURCE_ATTRIBUTES têm precedência
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("vox-twitch-dashboard")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		slog.Warn("detecting trace resource", "error", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// untracedPaths are the long-lived connections, whose spans would last as
+// long as them, and the scrapes of Prometheus.
+var untracedPaths = []string{"/ws/", "/status/events", "/metrics"}
+
+// traceRoutes starts a span for each request to mux, named after the
+// pattern it matched, continuing the trace of the caller if it sent one.
+func traceRoutes(mux *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, route := mux.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			return r.Method + " " + route
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			for _, path := range untracedPaths {
+				if strings.HasPrefix(r.URL.Path, path) {
+					return false
+				}
+			}
+			return true
+		}),
+	)
+}
+
+// redisTracing is a redis.Hook that traces the commands sent as part of a
+// traced operation; the ones of background work would only add noise.
+type redisTracing struct{}
+
+// redisSpanKey keeps the span of a command in its context, so AfterProcess
+// doesn't end the span of the caller when it didn't start one.
+type redisSpanKey struct{}
+
+func (redisTracing) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+	ctx, span := tracer.Start(ctx, "redis "+cmd.Name(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, semconv.DBOperationName(cmd.Name())),
+	)
+	return context.WithValue(ctx, redisSpanKey{}, span), nil
+}
+
+func (redisTracing) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	span, ok := ctx.Value(redisSpanKey{}).(trace.Span)
+	if !ok {
+		return nil
+	}
+	err := cmd.Err()
+	if err == redis.Nil {
+		err = nil
+	}
+	endSpan(span, err)
+	return nil
+}
+
+func (redisTracing) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.Name()
+	}
+	ctx, span := tracer.Start(ctx, "redis pipeline",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemRedis,
+			semconv.DBOperationName("pipeline"),
+			attribute.StringSlice("db.redis.commands", names),
+		),
+	)
+	return context.WithValue(ctx, redisSpanKey{}, span), nil
+}
+
+func (redisTracing) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	span, ok := ctx.Value(redisSpanKey{}).(trace.Span)
+	if !ok {
+		return nil
+	}
+	var err error
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil && cmdErr != redis.Nil {
+			err = cmdErr
+			break
+		}
+	}
+	endSpan(span, err)
+	return nil
+}
+
+// amqpHeaders carries the trace context in the headers of an AMQP message,
+// for the TTS worker to continue the trace.
+type amqpHeaders amqp.Table
+
+func (h amqpHeaders) Get(key string) string {
+	value, _ := h[key].(string)
+	return value
+}
+
+func (h amqpHeaders) Set(key, value string) {
+	h[key] = value
+}
+
+func (h amqpHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// helixSpan starts the span of a helix call, which helix can't trace on its
+// own as its methods take no context.
+func helixSpan(ctx context.Context, call string) trace.Span {
+	_, span := tracer.Start(ctx, "helix "+call, trace.WithSpanKind(trace.SpanKindClient))
+	return span
+}
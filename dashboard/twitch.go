@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// appTokenMargin is how long before expiring the app access token is
+// replaced.
+const appTokenMargin = 5 * time.Minute
+
+// twitchAPI is the single place that knows how to talk to Twitch: it holds
+// the client credentials, shares one app access token between every caller
+// and keeps it refreshed.
+//
+// TWITCH_API_URL and TWITCH_AUTH_URL point it somewhere else than Twitch,
+// e.g. at the mock server of the Twitch CLI ("twitch mock-api start"):
+//
+//	TWITCH_API_URL=http://localhost:8080/mock
+//	TWITCH_AUTH_URL=http://localhost:8080/auth
+type twitchAPI struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	apiBaseURL   string
+	httpClient   helix.HTTPClient
+
+	mu        sync.Mutex
+	appToken  string
+	expiresAt time.Time
+
+	// Rate limit bucket of the app access token, as Twitch last reported
+	// it.
+	rateMu        sync.Mutex
+	rateRemaining int
+	rateReset     time.Time
+}
+
+func newTwitchAPI(clientID, clientSecret, redirectURL string) (*twitchAPI, error) {
+	if id := os.Getenv("TWITCH_CLIENT_ID"); id != "" {
+		clientID = id
+	}
+	if secret := os.Getenv("TWITCH_CLIENT_SECRET"); secret != "" {
+		clientSecret = secret
+	}
+	t := &twitchAPI{
+		clientID:     strings.TrimSpace(clientID),
+		clientSecret: strings.TrimSpace(clientSecret),
+		redirectURL:  redirectURL,
+		apiBaseURL:   os.Getenv("TWITCH_API_URL"),
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: otelhttp.NewTransport(newInstrumentedTransport("twitch", nil)),
+		},
+	}
+	if authURL := os.Getenv("TWITCH_AUTH_URL"); authURL != "" {
+		target, err := url.Parse(authURL)
+		if err != nil {
+			return nil, fmt.Errorf("TWITCH_AUTH_URL: %w", err)
+		}
+		t.httpClient = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: otelhttp.NewTransport(newInstrumentedTransport("twitch", &authRewriter{target: target, next: http.DefaultTransport})),
+		}
+	}
+	return t, nil
+}
+
+// App returns a client authenticated with the app access token. Each call
+// gets its own client, as helix clients aren't safe for concurrent use,
+// but they all share the token and its rate limit bucket.
+func (t *twitchAPI) App() (*helix.Client, error) {
+	token, err := t.appAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	return t.newClient(&helix.Options{
+		AppAccessToken: token,
+		HTTPClient:     appHTTPClient{t},
+		// helix só repete pedidos que levaram 429 com uma RateLimitFunc;
+		// quem espera o bucket encher é o appHTTPClient
+		RateLimitFunc: func(*helix.Response) error { return nil },
+	})
+}
+
+// appAccessToken returns the app access token, requesting a new one when
+// the current one is about to expire.
+func (t *twitchAPI) appAccessToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Until(t.expiresAt) > appTokenMargin {
+		return t.appToken, nil
+	}
+
+	client, err := t.newClient(&helix.Options{})
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.RequestAppAccessToken(nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("RequestAppAccessToken: %d %s", resp.StatusCode, resp.ErrorMessage)
+	}
+	t.appToken = resp.Data.AccessToken
+	t.expiresAt = time.Now().Add(time.Duration(resp.Data.ExpiresIn) * time.Second)
+	slog.Info("new app access token", "expires_at", t.expiresAt)
+	return t.appToken, nil
+}
+
+// User returns a client acting on behalf of the user owning accessToken.
+func (t *twitchAPI) User(accessToken string) (*helix.Client, error) {
+	return t.newClient(&helix.Options{UserAccessToken: accessToken})
+}
+
+// OAuth returns a client for the authorization code flow.
+func (t *twitchAPI) OAuth() (*helix.Client, error) {
+	return t.newClient(&helix.Options{RedirectURI: t.redirectURL})
+}
+
+// apiURL is the URL of path on the Twitch API, for the calls helix lacks.
+func (t *twitchAPI) apiURL(path string) string {
+	if t.apiBaseURL == "" {
+		return helix.DefaultAPIBaseURL + path
+	}
+	return t.apiBaseURL + path
+}
+
+func (t *twitchAPI) newClient(options *helix.Options) (*helix.Client, error) {
+	options.ClientID = t.clientID
+	options.ClientSecret = t.clientSecret
+	options.APIBaseURL = t.apiBaseURL
+	if options.HTTPClient == nil {
+		options.HTTPClient = t.httpClient
+	}
+	return helix.NewClient(options)
+}
+
+// appHTTPClient makes the requests of the app clients: before each one
+// (and again after a 429), when Twitch said the bucket is empty, it waits
+// for the bucket to refill.
+type appHTTPClient struct {
+	t *twitchAPI
+}
+
+func (c appHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.t.waitRateLimit()
+	resp, err := c.t.httpClient.Do(req)
+	if err == nil {
+		c.t.recordRateLimit(resp.Header)
+	}
+	return resp, err
+}
+
+func (t *twitchAPI) waitRateLimit() {
+	t.rateMu.Lock()
+	empty, reset := t.rateRemaining <= 0, t.rateReset
+	t.rateMu.Unlock()
+	if !empty {
+		return
+	}
+	if wait := time.Until(reset); wait > 0 {
+		slog.Warn("twitch rate limit reached, waiting", "wait", wait)
+		time.Sleep(wait)
+	}
+}
+
+func (t *twitchAPI) recordRateLimit(header http.Header) {
+	if header.Get("Ratelimit-Limit") == "" {
+		return
+	}
+	remaining, _ := strconv.Atoi(header.Get("Ratelimit-Remaining"))
+	reset, _ := strconv.ParseInt(header.Get("Ratelimit-Reset"), 10, 64)
+	t.rateMu.Lock()
+	defer t.rateMu.Unlock()
+	t.rateRemaining, t.rateReset = remaining, time.Unix(reset, 0)
+}
+
+// authRewriter sends the requests helix makes to id.twitch.tv somewhere
+// else, as helix only lets the API base URL be configured.
+type authRewriter struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (a *authRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.String(), helix.AuthBaseURL) {
+		return a.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = a.target.Scheme
+	req.URL.Host = a.target.Host
+	req.URL.Path = a.target.Path + strings.TrimPrefix(req.URL.Path, "/oauth2")
+	req.Host = a.target.Host
+	return a.next.RoundTrip(req)
+}
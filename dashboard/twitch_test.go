@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix"
+)
+
+// mockTwitch is a fake of the Twitch auth server and of the helix
+// endpoints the dashboard uses, for tests of twitchAPI and its callers.
+type mockTwitch struct {
+	*httptest.Server
+
+	// tokenTTL is the lifetime of the app access tokens it hands out.
+	tokenTTL time.Duration
+	// users are the users GET /helix/users knows, by ID.
+	users map[string]helix.User
+
+	tokenRequests atomic.Int32
+	userRequests  atomic.Int32
+	// rateRemaining is what it reports in Ratelimit-Remaining.
+	rateRemaining atomic.Int32
+}
+
+// newMockTwitch starts a mockTwitch and points TWITCH_API_URL and
+// TWITCH_AUTH_URL at it for the rest of the test.
+func newMockTwitch(t *testing.T) *mockTwitch {
+	m := &mockTwitch{
+		tokenTTL: time.Hour,
+		users: map[string]helix.User{
+			"1": {ID: "1", Login: "monique", DisplayName: "Monique"},
+			"2": {ID: "2", Login: "capivara", DisplayName: "Capivara"},
+		},
+	}
+	m.rateRemaining.Store(800)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Query().Get("grant_type") != "client_credentials" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		n := m.tokenRequests.Add(1)
+		writeJSON(w, map[string]interface{}{
+			"access_token": "app-token-" + strconv.Itoa(int(n)),
+			"expires_in":   int(m.tokenTTL.Seconds()),
+			"token_type":   "bearer",
+		})
+	})
+	mux.HandleFunc("/helix/users", func(w http.ResponseWriter, r *http.Request) {
+		m.userRequests.Add(1)
+		if r.Header.Get("Client-Id") != "client-id" || r.Header.Get("Authorization") == "" {
+			http.Error(w, `{"error":"Unauthorized","status":401}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Ratelimit-Limit", "800")
+		w.Header().Set("Ratelimit-Remaining", strconv.Itoa(int(m.rateRemaining.Load())))
+		w.Header().Set("Ratelimit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+		users := []helix.User{}
+		for _, id := range r.URL.Query()["id"] {
+			if user, ok := m.users[id]; ok {
+				users = append(users, user)
+			}
+		}
+		for _, login := range r.URL.Query()["login"] {
+			for _, user := range m.users {
+				if user.Login == login {
+					users = append(users, user)
+				}
+			}
+		}
+		writeJSON(w, map[string]interface{}{"data": users})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	t.Setenv("TWITCH_API_URL", m.URL+"/helix")
+	t.Setenv("TWITCH_AUTH_URL", m.URL+"/auth")
+	t.Setenv("TWITCH_CLIENT_ID", "client-id")
+	t.Setenv("TWITCH_CLIENT_SECRET", "client-secret")
+	return m
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newMockTwitchAPI(t *testing.T) (*twitchAPI, *mockTwitch) {
+	m := newMockTwitch(t)
+	twitch, err := newTwitchAPI("", "", "http://localhost/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return twitch, m
+}
+
+// getUsers asks for ids through an app client. It may run outside the test
+// goroutine, so failures are only reported.
+func getUsers(t *testing.T, twitch *twitchAPI, ids ...string) []helix.User {
+	t.Helper()
+	client, err := twitch.App()
+	if err != nil {
+		t.Errorf("App() error = %v", err)
+		return nil
+	}
+	resp, err := client.GetUsers(&helix.UsersParams{IDs: ids})
+	if err != nil {
+		t.Errorf("GetUsers() error = %v", err)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GetUsers() status = %d %s", resp.StatusCode, resp.ErrorMessage)
+		return nil
+	}
+	return resp.Data.Users
+}
+
+func TestTwitchAPIAppSharesToken(t *testing.T) {
+	twitch, m := newMockTwitchAPI(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if users := getUsers(t, twitch, "1", "2", "3"); len(users) != 2 {
+				t.Errorf("GetUsers() = %d users, want 2", len(users))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := m.tokenRequests.Load(); n != 1 {
+		t.Errorf("%d app token requests, want 1", n)
+	}
+	if n := m.userRequests.Load(); n != 10 {
+		t.Errorf("%d user requests, want 10", n)
+	}
+}
+
+func TestTwitchAPIRenewsExpiringToken(t *testing.T) {
+	twitch, m := newMockTwitchAPI(t)
+	// expira dentro da margem, então cada pedido pega um token novo
+	m.tokenTTL = appTokenMargin / 2
+
+	getUsers(t, twitch, "1")
+	getUsers(t, twitch, "1")
+	if n := m.tokenRequests.Load(); n != 2 {
+		t.Errorf("%d app token requests, want 2", n)
+	}
+}
+
+func TestTwitchAPIRecordsRateLimit(t *testing.T) {
+	twitch, m := newMockTwitchAPI(t)
+	m.rateRemaining.Store(0)
+
+	getUsers(t, twitch, "1")
+	twitch.rateMu.Lock()
+	remaining, reset := twitch.rateRemaining, twitch.rateReset
+	twitch.rateMu.Unlock()
+	if remaining != 0 || reset.IsZero() {
+		t.Errorf("rate limit = %d until %v, want 0 until the reset sent", remaining, reset)
+	}
+	// o reset já passou, então o próximo pedido não espera
+	getUsers(t, twitch, "2")
+}
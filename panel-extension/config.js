@@ -1,71 +1,98 @@
-let token, userId;
-let options = []
+let token;
 
-// so we don't have to write this out everytime 
+// so we don't have to write this out everytime
 const twitch = window.Twitch.ext;
 
-// onContext callback called when context of an extension is fired 
-twitch.onContext((context) => {
-    //console.log(context);
-});
+// const configURL = '//localhost:7001/extension/config'
+const configURL = 'https://vox-twitch.monique.dev/extension/config'
 
+const anonymousPolicyNames = {
+    anonymous: 'Mostrar como anônimo',
+    nickname: 'Dar um apelido',
+    reject: 'Bloquear',
+}
 
 // onAuthorized callback called each time JWT is fired
 twitch.onAuthorized((auth) => {
     // save our credentials
     token = auth.token; //JWT passed to backend for authentication
-    userId = auth.userId; //opaque userID
+    load()
 });
 
+function request(method, settings) {
+    return $.ajax({
+        url: configURL,
+        type: method,
+        headers: {Authorization: 'Bearer ' + token},
+        contentType: 'application/json',
+        data: settings && JSON.stringify(settings),
+        dataType: 'json',
+    })
+}
 
-// when the config changes, save the new changes! 
-twitch.configuration.onChanged(() => {
-    // console.log(twitch.configuration.broadcaster)
-    // console.log("in onChanged")
-    if (twitch.configuration.broadcaster) {
-        // console.log("config exists")
-        try {
-            var config = JSON.parse(twitch.configuration.broadcaster.content)
-            //console.log(typeof config)
-            if (typeof config === "object") {
-                options = config
-                updateOptions()
-                //console.log(options)
-            } else {
-                // console.log('invalid config')
-            }
-        } catch (e) {
-            // console.log('invalid config')
-        }
-    }
-})
+function status(text, isError) {
+    $('#status').text(text).toggleClass('error', !!isError)
+}
 
-function updateConfig() {
-    //console.log('in set')
-    //console.log(options)
-    //console.log(typeof options)
-    //console.log(JSON.stringify(options))
-    twitch.configuration.set("broadcaster", "1", JSON.stringify(options))
-    //console.log("has it been set?")
-    //console.log(twitch.configuration.broadcaster.content)
+// the server validates and keeps the settings, also writing them to the
+// broadcaster segment, so the form is always filled from there
+function load() {
+    request('GET')
+        .done(fill)
+        .fail((xhr) => status(xhr.responseText || 'Não foi possível carregar as configurações.', true))
+}
 
+function fill(config) {
+    const form = $('#form')
+    const settings = config.settings
+
+    $('#voices').empty()
+    $.each(config.voices, (i, voice) => {
+        const input = $('<input type="checkbox" name="voices">').val(voice)
+            .prop('checked', settings.voices.includes(voice))
+        $('#voices').append($('<label>').append(input, ' ' + voice))
+    })
+
+    form.find('select[name=theme]').empty().append(
+        config.themes.map((theme) => $('<option>').val(theme).text(theme)))
+    form.find('select[name=anonymous_policy]').empty().append(
+        config.anonymous_policies.map((policy) => $('<option>').val(policy).text(anonymousPolicyNames[policy] || policy)))
+
+    form.find('[name=enabled]').prop('checked', settings.enabled)
+    form.find('[name=max_length]').val(settings.max_length)
+    form.find('[name=cooldown_seconds]').val(settings.cooldown_seconds)
+    form.find('[name=history_days]').val(settings.history_days)
+    form.find('[name=filters]').val((settings.filters || []).join('\n'))
+    form.find('[name=approval_mode]').prop('checked', settings.approval_mode)
+    form.find('[name=theme]').val(settings.theme)
+    form.find('[name=anonymous_policy]').val(settings.anonymous_policy)
+    form.prop('hidden', false)
+}
+
+function read() {
+    const form = $('#form')
+    return {
+        enabled: form.find('[name=enabled]').prop('checked'),
+        voices: form.find('[name=voices]:checked').map((i, input) => input.value).get(),
+        max_length: parseInt(form.find('[name=max_length]').val(), 10),
+        cooldown_seconds: parseInt(form.find('[name=cooldown_seconds]').val(), 10),
+        history_days: parseInt(form.find('[name=history_days]').val(), 10),
+        filters: form.find('[name=filters]').val().split('\n').map((word) => word.trim()).filter((word) => word),
+        approval_mode: form.find('[name=approval_mode]').prop('checked'),
+        theme: form.find('[name=theme]').val(),
+        anonymous_policy: form.find('[name=anonymous_policy]').val(),
+    }
 }
 
-// Function to save the streamer's WYR options  
 $(() => {
-    $("#form").submit((e) => {
-        options = []
-        $('input[type=checkbox]').each(() => {
-            if (this.checked) {
-                var option = $(this).val();
-                //console.log(typeof option)
-                //console.log(options.push(value))
-                options.push(option)
-            }
-        })
-        //console.log(options)
-        //updateOptions()
+    $('#form').submit((e) => {
         e.preventDefault()
-        //console.log(options)
+        status('Salvando...')
+        request('POST', read())
+            .done((config) => {
+                fill(config)
+                status('Configurações salvas.')
+            })
+            .fail((xhr) => status(xhr.responseText || 'Não foi possível salvar as configurações.', true))
     })
 })
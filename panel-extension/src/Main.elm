@@ -41,12 +41,13 @@ type alias Model =
     , token : String
     , channelId : String
     , disableSubmit : Bool
+    , error : Maybe String
     }
 
 
 init : () -> ( Model, Cmd Msg )
 init _ =
-    ( Model "" "" "" True, Cmd.none )
+    ( Model "" "" "" True Nothing, Cmd.none )
 
 
 
@@ -56,7 +57,7 @@ init _ =
 type Msg
     = Submitted
     | TextChanged String
-    | Posted (Result Http.Error ())
+    | Posted (Result String ())
     | Authorized (List String)
     | KeyDown Int
 
@@ -79,8 +80,13 @@ update msg model =
                 _ ->
                     ( model, Cmd.none )
 
-        Posted _ ->
-            ( { model | disableSubmit = False }, Cmd.none )
+        Posted result ->
+            case result of
+                Ok _ ->
+                    ( { model | disableSubmit = False, error = Nothing }, Cmd.none )
+
+                Err error ->
+                    ( { model | disableSubmit = False, error = Just error }, Cmd.none )
 
         Submitted ->
             let
@@ -112,13 +118,29 @@ submitSpeech token text =
         , headers = [ Http.header "Authorization" ("Bearer " ++ token) ]
         , url = "https://vox-twitch.monique.dev/tts/"
         , body = Http.multipartBody [ Http.stringPart "text" text ]
-        , expect = Http.expectWhatever Posted
+        , expect = Http.expectStringResponse Posted expectError
         , timeout = Nothing
         , tracker = Nothing
         }
 
 
 
+{-| O servidor explica em texto por que recusou a mensagem.
+-}
+expectError : Http.Response String -> Result String ()
+expectError response =
+    case response of
+        Http.GoodStatus_ _ _ ->
+            Ok ()
+
+        Http.BadStatus_ _ body ->
+            Err body
+
+        _ ->
+            Err "Não foi possível enviar a mensagem. Tente de novo."
+
+
+
 -- SUBSCRIPTIONS
 
 
@@ -131,6 +153,16 @@ subscriptions _ =
 -- VIEW
 
 
+errorView : Maybe String -> Html msg
+errorView error =
+    case error of
+        Just message ->
+            div [ class "alert alert-warning p-1" ] [ text message ]
+
+        Nothing ->
+            text ""
+
+
 onKeyDown : (Int -> msg) -> Attribute msg
 onKeyDown tagger =
     on "keydown" (Json.map tagger keyCode)
@@ -161,6 +193,7 @@ view model =
                         ]
                         []
                     ]
+                , errorView model.error
                 , input
                     [ class "btn btn-color"
                     , type_ "submit"